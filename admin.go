@@ -0,0 +1,367 @@
+package main
+
+import (
+	"github.com/dchest/uniuri"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	RoleViewer     = "viewer"
+	RoleSupport    = "support"
+	RoleFinance    = "finance"
+	RoleSuperAdmin = "superadmin"
+
+	PermissionOrdersRead   = "orders.read"
+	PermissionOrdersManage = "orders.manage"
+	PermissionOrdersRefund = "orders.refund"
+	PermissionReconcile    = "reconcile"
+	PermissionUsersProtect = "users.protect"
+	PermissionRiskExport   = "risk.export"
+	PermissionCoupons      = "coupons"
+	PermissionRolesManage  = "roles.manage"
+	PermissionAudit        = "audit"
+	PermissionStats        = "stats"
+
+	// AdminAccountPrefix marks the tokens of separate admin accounts, so that they never collide with AuthMe usernames
+	AdminAccountPrefix = "admin:"
+
+	ErrorMessageRoleUnknown         = "未知的角色"
+	ErrorMessageAdminAccountExists  = "管理员账号已存在"
+	ErrorMessageAdminLoginIncorrect = "用户名或密码错误"
+)
+
+var (
+	// rolePermissions lists the permissions granted to each role
+	rolePermissions = map[string][]string{
+		RoleViewer: {
+			PermissionOrdersRead,
+		},
+		RoleSupport: {
+			PermissionOrdersRead,
+			PermissionOrdersManage,
+			PermissionUsersProtect,
+		},
+		RoleFinance: {
+			PermissionOrdersRead,
+			PermissionOrdersRefund,
+			PermissionReconcile,
+			PermissionRiskExport,
+			PermissionCoupons,
+			PermissionStats,
+		},
+		RoleSuperAdmin: {
+			PermissionOrdersRead,
+			PermissionOrdersManage,
+			PermissionOrdersRefund,
+			PermissionReconcile,
+			PermissionUsersProtect,
+			PermissionRiskExport,
+			PermissionCoupons,
+			PermissionRolesManage,
+			PermissionAudit,
+			PermissionStats,
+		},
+	}
+)
+
+// AdminRole grants a role to an AuthMe user
+type AdminRole struct {
+	Username  string    `gorm:"size:255;primary_key" json:"username"`
+	Role      string    `gorm:"size:32;NOT NULL" json:"role"`
+	GrantedBy string    `gorm:"size:255" json:"granted_by"`
+	GrantedAt time.Time `json:"granted_at"`
+}
+
+// AdminAccount is an operator account separated from the game accounts in AuthMe.
+// Password is stored in the same $SHA$salt$hash format as AuthMe does.
+type AdminAccount struct {
+	Username  string    `gorm:"size:64;primary_key" json:"username"`
+	Password  string    `gorm:"size:255;NOT NULL" json:"-"`
+	Role      string    `gorm:"size:32;NOT NULL" json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type AdminLoginRequest struct {
+	Username  string `json:"username" validate:"required,min=2,max=64"`
+	Password  string `json:"password" validate:"required,min=8,max=64"`
+	ReCAPTCHA string `json:"recaptcha" validate:"required"`
+}
+
+type GrantRoleRequest struct {
+	Role string `json:"role" validate:"required,oneof=viewer support finance superadmin"`
+}
+
+type CreateAdminAccountRequest struct {
+	Username string `json:"username" validate:"required,min=2,max=64"`
+	Password string `json:"password" validate:"required,min=8,max=64"`
+	Role     string `json:"role" validate:"required,oneof=viewer support finance superadmin"`
+}
+
+type GenerateCouponsRequest struct {
+	Batch     string     `json:"batch" validate:"required,max=64"`
+	Count     int        `json:"count" validate:"required,min=1,max=1000"`
+	Type      string     `json:"type" validate:"required,oneof=fixed_discount percent_discount coin_grant"`
+	Value     uint64     `json:"value" validate:"required,min=1"`
+	MaxUses   uint       `json:"max_uses"`
+	UserLimit uint       `json:"user_limit"`
+	ExpireAt  *time.Time `json:"expire_at"`
+}
+
+func hasPermission(role string, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAdminPassword hashes password with a new salt in the $SHA$salt$hash format understood by checkUserCredentials
+func hashAdminPassword(password string) string {
+	salt := uniuri.NewLen(16)
+	return strings.Join([]string{"", "SHA", salt, authMeCalculateHash(password, salt)}, "$")
+}
+
+// findAdminRole looks up the role of the owner of a token; returns an empty role if there is none
+func findAdminRole(username string) (string, error) {
+	if strings.HasPrefix(username, AdminAccountPrefix) {
+		var account AdminAccount
+		err := WebData.Where("username = ?", strings.TrimPrefix(username, AdminAccountPrefix)).First(&account).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return "", nil
+		}
+		return account.Role, err
+	}
+
+	if currentSettings().AdminUsernames[username] {
+		return RoleSuperAdmin, nil
+	}
+
+	var role AdminRole
+	err := WebData.Where("username = ?", username).First(&role).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return "", nil
+	}
+	return role.Role, err
+}
+
+// needAdmin only allows the users granted a role. Has to be used after needToken.
+// The role is stored into the context as "role".
+func needAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		username := c.Get("token").(*Token).ParentUsername
+		role, err := findAdminRole(username)
+		if err != nil {
+			requestLog(c, LogAuth).Errorf("find admin role error: %v", err)
+			return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+		}
+		if role == "" {
+			requestLog(c, LogAuth).Warnf("non-admin user %s attempted to access %s", username, c.Path())
+			return NewErrorResponse(http.StatusForbidden, ErrorMessageNeedAdmin)
+		}
+
+		c.Set("role", role)
+		return next(c)
+	}
+}
+
+// needPermission only allows the roles granted permission. Has to be used after needAdmin.
+func needPermission(permission string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			role := c.Get("role").(string)
+			if !hasPermission(role, permission) {
+				requestLog(c, LogAuth).Warnf("%s %s lacks permission %s to access %s",
+					role, c.Get("token").(*Token).ParentUsername, permission, c.Path())
+				return NewErrorResponse(http.StatusForbidden, ErrorMessageNeedAdmin)
+			}
+			return next(c)
+		}
+	}
+}
+
+func validateAdmin(c echo.Context) error {
+	var form AdminLoginRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	// gated as the user login is, so that the passwords could not be guessed over the public api
+	if err := verifyReCAPTCHA(c, form.ReCAPTCHA); err != nil {
+		return err
+	}
+
+	// the failures are only logged, as anyone could cause them and they would flood the audit chain
+	var account AdminAccount
+	err := WebData.Where("username = ?", form.Username).First(&account).Error
+	if err != nil || !checkUserCredentials(account.Password, form.Password) {
+		requestLog(c, LogAuth).Warnf("admin login failed for %s from %s: %v", form.Username, c.RealIP(), err)
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageAdminLoginIncorrect)
+	}
+
+	token := Token{
+		Token:          uniuri.NewLen(32),
+		ExpireAt:       time.Now().Add(TokenLifetime),
+		ParentUsername: AdminAccountPrefix + account.Username,
+	}
+	if err = WebData.Create(&token).Error; err != nil {
+		requestLog(c, LogDb).Errorf("create token error: %v", err)
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageTokenError)
+	}
+	auditAs(c, token.ParentUsername, AuditActionAdminLogin, token.ParentUsername, "", nil, nil)
+
+	return c.JSON(http.StatusAccepted, UserLoginResponse{
+		Username: token.ParentUsername,
+		Token:    token.Token,
+	})
+}
+
+func retrieveAdminInfo(c echo.Context) error {
+	role := c.Get("role").(string)
+	return c.JSON(http.StatusOK, echo.Map{
+		"username":    c.Get("token").(*Token).ParentUsername,
+		"role":        role,
+		"permissions": rolePermissions[role],
+	})
+}
+
+func listAdminRoles(c echo.Context) error {
+	var roles []AdminRole
+	if err := WebData.Order("username").Find(&roles).Error; err != nil {
+		requestLog(c, LogDb).Errorf("find admin roles error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	var accounts []AdminAccount
+	if err := WebData.Order("username").Find(&accounts).Error; err != nil {
+		requestLog(c, LogDb).Errorf("find admin accounts error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"roles":    roles,
+		"accounts": accounts,
+	})
+}
+
+// grantAdminRole grants a role to an AuthMe user, replacing the role granted before
+func grantAdminRole(c echo.Context) error {
+	var form GrantRoleRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("validate form error: %v", err)
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageRoleUnknown)
+	}
+
+	role := AdminRole{
+		Username:  c.Param("username"),
+		Role:      form.Role,
+		GrantedBy: c.Get("token").(*Token).ParentUsername,
+		GrantedAt: time.Now(),
+	}
+	if err := WebData.Save(&role).Error; err != nil {
+		requestLog(c, LogDb).Errorf("save admin role error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionGrantRole, "user:"+role.Username, "", nil, role)
+	return c.JSON(http.StatusOK, role)
+}
+
+func revokeAdminRole(c echo.Context) error {
+	err := WebData.Where("username = ?", c.Param("username")).Delete(&AdminRole{}).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("delete admin role error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionRevokeRole, "user:"+c.Param("username"), "", nil, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func createAdminAccount(c echo.Context) error {
+	var form CreateAdminAccountRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	var existing int
+	if WebData.Model(&AdminAccount{}).Where("username = ?", form.Username).Count(&existing); existing != 0 {
+		return NewErrorResponse(http.StatusConflict, ErrorMessageAdminAccountExists)
+	}
+
+	account := AdminAccount{
+		Username:  form.Username,
+		Password:  hashAdminPassword(form.Password),
+		Role:      form.Role,
+		CreatedAt: time.Now(),
+	}
+	if err := WebData.Create(&account).Error; err != nil {
+		requestLog(c, LogDb).Errorf("create admin account error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionCreateAccount, AdminAccountPrefix+account.Username, "", nil, account)
+	return c.JSON(http.StatusCreated, account)
+}
+
+func deleteAdminAccount(c echo.Context) error {
+	username := c.Param("username")
+	err := WebData.Where("username = ?", username).Delete(&AdminAccount{}).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("delete admin account error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	// sign the account out everywhere
+	err = WebData.Where("parent_username = ?", AdminAccountPrefix+username).Delete(&Token{}).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("delete admin tokens error: %v", err)
+	}
+	audit(c, AuditActionDeleteAccount, AdminAccountPrefix+username, "", nil, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+func generateCouponBatch(c echo.Context) error {
+	var form GenerateCouponsRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	coupons, err := generateCoupons(form.Batch, form.Count, Coupon{
+		Type:      form.Type,
+		Value:     form.Value,
+		MaxUses:   form.MaxUses,
+		UserLimit: form.UserLimit,
+		ExpireAt:  form.ExpireAt,
+	})
+	if err != nil {
+		requestLog(c, LogDb).Errorf("generate coupons error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionCoupons, "batch:"+form.Batch, "", nil, echo.Map{
+		"type":  form.Type,
+		"value": form.Value,
+		"count": len(coupons),
+	})
+	return c.JSON(http.StatusCreated, coupons)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/dchest/uniuri"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+const (
+	ErrorMessageOrderStateConflict   = "订单当前状态无法执行该操作"
+	ErrorMessagePlatformOrderInvalid = "支付平台订单号与订单不符"
+	ErrorMessageDeliveryFailed       = "发货失败，稍后请重试"
+	ErrorMessageOrderPaidUpstream    = "订单已在支付平台付款，无法取消"
+	ErrorMessageOrderPayable         = "收银台订单仍可支付，请在其过期后取消"
+	ErrorMessageCompensationFailed   = "补偿发放失败，稍后请重试"
+
+	// TransactionTypeManual marks the orders marked paid by hand
+	TransactionTypeManual = "manual"
+)
+
+// OrderActionRequest carries the reason required by every manual action
+type OrderActionRequest struct {
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+// MarkOrderPaidRequest marks an order paid outside of the notifications, e.g. confirmed on the platform dashboard.
+// Aoid is required for the orders paid on the cashier page, whose aoid is not known yet.
+type MarkOrderPaidRequest struct {
+	Reason        string     `json:"reason" validate:"required,max=255"`
+	Evidence      string     `json:"evidence" validate:"required,max=1024"`
+	Aoid          string     `json:"aoid" validate:"max=32"`
+	TransactionID string     `json:"transaction_id" validate:"max=64"`
+	PaidAt        *time.Time `json:"paid_at"`
+}
+
+type CompensationRequest struct {
+	Reason  string `json:"reason" validate:"required,max=255"`
+	Coins   uint64 `json:"coins" validate:"required,min=1"`
+	OrderID string `json:"order_id" validate:"max=32"`
+}
+
+// CompensationGrant is the outcome of a compensation, GrantID identifies it in the game database
+type CompensationGrant struct {
+	GrantID  string `json:"grant_id"`
+	Username string `json:"username"`
+	Coins    uint64 `json:"coins"`
+	OrderID  string `json:"order_id,omitempty"`
+}
+
+func bindOrderAction(c echo.Context, form interface{}) (*Order, error) {
+	if err := c.Bind(form); err != nil {
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
+		return nil, DefaultBadRequestResponse
+	}
+	if err := c.Validate(form); err != nil {
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
+		return nil, DefaultBadRequestResponse
+	}
+
+	var order Order
+	err := WebData.Where("order_id = ?", c.Param("orderId")).First(&order).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, NewErrorResponse(http.StatusNotFound, ErrorMessageOrderNotFound)
+	} else if err != nil {
+		requestLog(c, LogDb).Errorf("find order error: %v", err)
+		return nil, NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return &order, nil
+}
+
+func orderActionErrorResponse(err error) *echo.HTTPError {
+	switch err {
+	case ErrOrderStateConflict:
+		return NewErrorResponse(http.StatusConflict, ErrorMessageOrderStateConflict)
+	case ErrPlatformOrderMismatch:
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessagePlatformOrderInvalid)
+	default:
+		LogDb.Errorf("order action error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+}
+
+// markOrderPaid settles an unpaid order as if its notification had arrived, delivering it unless held for review
+func markOrderPaid(c echo.Context) error {
+	var form MarkOrderPaidRequest
+	order, err := bindOrderAction(c, &form)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderStatusCreated {
+		return orderActionErrorResponse(ErrOrderStateConflict)
+	}
+
+	platformOrderId := order.PlatformOrderID
+	if form.Aoid != "" {
+		platformOrderId = form.Aoid
+	}
+	paidAt := time.Now()
+	if form.PaidAt != nil {
+		paidAt = *form.PaidAt
+	}
+
+	before := newAdminOrder(*order)
+	settled, err := settleOrder(order.OrderID, platformOrderId, paidAt, xorpay.PlatformNotifyResponseDetail{
+		TransactionID:   form.TransactionID,
+		TransactionType: TransactionTypeManual,
+	})
+	if err != nil {
+		return orderActionErrorResponse(err)
+	}
+
+	audit(c, AuditActionMarkPaid, "order:"+order.OrderID, form.Reason, before, echo.Map{
+		"order":    newAdminOrder(*settled),
+		"evidence": form.Evidence,
+	})
+	return c.JSON(http.StatusOK, newAdminOrder(*settled))
+}
+
+// retryOrderDelivery delivers a paid order again, or releases an order held for review
+func retryOrderDelivery(c echo.Context) error {
+	var form OrderActionRequest
+	order, err := bindOrderAction(c, &form)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderStatusPaid && order.Status != OrderStatusHeld {
+		return orderActionErrorResponse(ErrOrderStateConflict)
+	}
+
+	before := newAdminOrder(*order)
+	if err = deliverOrder(order); err == ErrOrderStateConflict {
+		return orderActionErrorResponse(err)
+	} else if err != nil {
+		requestLog(c, LogPay).Errorf("deliver order %s error: %v", order.OrderID, err)
+		return NewErrorResponse(http.StatusBadGateway, ErrorMessageDeliveryFailed)
+	}
+	RealtimeOrderBroker.Broadcast(order, order.OrderID)
+
+	audit(c, AuditActionRetryDelivery, "order:"+order.OrderID, form.Reason, before, newAdminOrder(*order))
+	return c.JSON(http.StatusOK, newAdminOrder(*order))
+}
+
+// markOrderDelivered marks a paid order delivered without storing it into the game database,
+// for the orders whose coins have been credited by other means
+func markOrderDelivered(c echo.Context) error {
+	var form OrderActionRequest
+	order, err := bindOrderAction(c, &form)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderStatusPaid && order.Status != OrderStatusHeld {
+		return orderActionErrorResponse(ErrOrderStateConflict)
+	}
+
+	before := newAdminOrder(*order)
+	now := time.Now()
+	err = transitOrder(WebData, order, OrderStatusDelivered, map[string]interface{}{
+		"processed_at": &now,
+	})
+	if err != nil {
+		return orderActionErrorResponse(err)
+	}
+	order.ProcessedAt = &now
+	order.Processed = true
+	RealtimeOrderBroker.Broadcast(order, order.OrderID)
+
+	audit(c, AuditActionMarkDelivered, "order:"+order.OrderID, form.Reason, before, newAdminOrder(*order))
+	return c.JSON(http.StatusOK, newAdminOrder(*order))
+}
+
+// cancelOrder closes an unpaid order on the platform, so that it could not be paid anymore,
+// and gives back the coupon it used. Cashier orders are refused until expired.
+func cancelOrder(c echo.Context) error {
+	var form OrderActionRequest
+	order, err := bindOrderAction(c, &form)
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderStatusCreated {
+		return orderActionErrorResponse(ErrOrderStateConflict)
+	}
+
+	// the orders still waiting on the cashier page could not be closed on the platform without their aoid,
+	// so they are only cancelled once the cashier page has expired and they could not be paid anymore
+	if order.awaitsPlatformOrderID() {
+		if time.Since(order.CreatedAt) < OrderPaymentLifetime {
+			return NewErrorResponse(http.StatusConflict, ErrorMessageOrderPayable)
+		}
+	} else {
+		err = PaySession.Close(c.Request().Context(), order.PlatformOrderID)
+		switch errors.Cause(err) {
+		case nil, xorpay.ErrOrderNotFound:
+		case xorpay.ErrOrderPaid:
+			return NewErrorResponse(http.StatusConflict, ErrorMessageOrderPaidUpstream)
+		default:
+			requestLog(c, LogPay).Errorf("close platform order %s error: %v", order.PlatformOrderID, err)
+			return payErrorResponse(err)
+		}
+	}
+
+	before := newAdminOrder(*order)
+	if err = abandonOrder(order); err != nil {
+		return orderActionErrorResponse(err)
+	}
+	RealtimeOrderBroker.Broadcast(order, order.OrderID)
+
+	audit(c, AuditActionCancel, "order:"+order.OrderID, form.Reason, before, newAdminOrder(*order))
+	return c.JSON(http.StatusOK, newAdminOrder(*order))
+}
+
+// compensateUser grants coins to a player without any payment, optionally referring to the order compensated
+func compensateUser(c echo.Context) error {
+	var form CompensationRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	grant := CompensationGrant{
+		GrantID:  uniuri.NewLenChars(32, OrderIDCharCandidates),
+		Username: c.Param("username"),
+		Coins:    form.Coins,
+		OrderID:  form.OrderID,
+	}
+	if err := grantCoins(grant.GrantID, grant.Username, grant.Coins); err != nil {
+		requestLog(c, LogPay).Errorf("grant compensation coins to %s error: %v", grant.Username, err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageCompensationFailed)
+	}
+
+	audit(c, AuditActionCompensate, "user:"+grant.Username, form.Reason, nil, grant)
+	return c.JSON(http.StatusCreated, grant)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"github.com/360EntSecGroup-Skylar/excelize"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ErrorMessageCursorInvalid = "分页游标无效"
+
+	DefaultOrderSearchLimit = 50
+	// DefaultNotificationSearchLimit bounds the notifications listed at once
+	DefaultNotificationSearchLimit = 100
+	// OrderExportMaxRows bounds the orders exported at once, since xlsx files are built in memory
+	OrderExportMaxRows = 50000
+
+	OrderExportFormatCSV  = "csv"
+	OrderExportFormatXLSX = "xlsx"
+)
+
+var orderExportHeader = []string{
+	"order_id", "aoid", "username", "status", "pay_type", "paid_price", "discount_price", "bonus_coins",
+	"coupon_code", "promotion_id", "transaction_id", "transaction_type", "client_ip",
+	"created_at", "paid_at", "processed_at", "refund_price", "refunded_at", "review_reason",
+}
+
+// OrderSearchRequest filters the orders searched by the admins. From and To are dates formatted as 2006-01-02,
+// Cursor is the NextCursor of the previous page.
+type OrderSearchRequest struct {
+	OrderID       string `query:"order_id" validate:"max=32"`
+	Aoid          string `query:"aoid" validate:"max=32"`
+	TransactionID string `query:"transaction_id" validate:"max=64"`
+	Username      string `query:"username" validate:"max=255"`
+	Status        string `query:"status" validate:"omitempty,oneof=created paid held delivered refunding refunded cancelled"`
+	PayType       string `query:"pay_type" validate:"max=32"`
+	MinPrice      uint64 `query:"min_price"`
+	MaxPrice      uint64 `query:"max_price"`
+	From          string `query:"from" validate:"omitempty,len=10"`
+	To            string `query:"to" validate:"omitempty,len=10"`
+
+	Cursor string `query:"cursor" validate:"max=128"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=500"`
+	Format string `query:"format" validate:"omitempty,oneof=csv xlsx"`
+}
+
+// NotificationSearchRequest filters the payment notifications by their handling result, the conflicts by default
+type NotificationSearchRequest struct {
+	Result string `query:"result" validate:"omitempty,oneof=received accepted duplicate conflict rejected sign_invalid error"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=500"`
+}
+
+// AdminOrder reveals the fields of an order hidden from its buyer
+type AdminOrder struct {
+	Order
+	PlatformOrderID string `json:"aoid"`
+	ParentUsername  string `json:"username"`
+	TransactionID   string `json:"transaction_id"`
+	ClientIP        string `json:"client_ip"`
+	ReviewReason    string `json:"review_reason"`
+}
+
+type OrderSearchResponse struct {
+	Orders     []AdminOrder `json:"orders"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+type OrderDetailResponse struct {
+	Order            AdminOrder            `json:"order"`
+	Notifications    []PaymentNotification `json:"notifications"`
+	DeliveryAttempts []DeliveryAttempt     `json:"delivery_attempts"`
+	// PaidOrder is the row delivered into the game database, if any
+	PaidOrder *PaidOrder `json:"paid_order"`
+}
+
+func newAdminOrder(order Order) AdminOrder {
+	return AdminOrder{
+		Order:           order,
+		PlatformOrderID: order.PlatformOrderID,
+		ParentUsername:  order.ParentUsername,
+		TransactionID:   order.TransactionID,
+		ClientIP:        order.ClientIP,
+		ReviewReason:    order.ReviewReason,
+	}
+}
+
+// encodeOrderCursor points right after order, the last one of a page ordered by created_at and order_id descending
+func encodeOrderCursor(order *Order) string {
+	raw := fmt.Sprintf("%d_%s", order.CreatedAt.Unix(), order.OrderID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeOrderCursor(cursor string) (time.Time, string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	parts := strings.SplitN(string(raw), "_", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", fmt.Errorf("malformed cursor %q", raw)
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return time.Unix(unix, 0), parts[1], nil
+}
+
+// filter applies the search conditions, leaving the cursor and the limit out
+func (q *OrderSearchRequest) filter(db *gorm.DB) (*gorm.DB, error) {
+	for _, field := range []struct {
+		value     string
+		condition string
+	}{
+		{q.OrderID, "order_id = ?"},
+		{q.Aoid, "platform_order_id = ?"},
+		{q.TransactionID, "transaction_id = ?"},
+		{q.Username, "parent_username = ?"},
+		{q.Status, "status = ?"},
+		{q.PayType, "pay_type = ?"},
+	} {
+		if field.value != "" {
+			db = db.Where(field.condition, field.value)
+		}
+	}
+	if q.MinPrice != 0 {
+		db = db.Where("paid_price >= ?", q.MinPrice)
+	}
+	if q.MaxPrice != 0 {
+		db = db.Where("paid_price <= ?", q.MaxPrice)
+	}
+	for _, bound := range []struct {
+		date      string
+		condition string
+	}{
+		{q.From, "created_at >= ?"},
+		{q.To, "created_at < ?"},
+	} {
+		if bound.date == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", bound.date, Timezone)
+		if err != nil {
+			return nil, err
+		}
+		db = db.Where(bound.condition, t)
+	}
+	return db, nil
+}
+
+func bindOrderSearch(c echo.Context) (*OrderSearchRequest, *gorm.DB, error) {
+	var query OrderSearchRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogDb).Warnf("bind query error: %v", err)
+		return nil, nil, DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil {
+		requestLog(c, LogDb).Warnf("validate query error: %v", err)
+		return nil, nil, DefaultBadRequestResponse
+	}
+
+	db, err := query.filter(WebData.Model(&Order{}))
+	if err != nil {
+		return nil, nil, DefaultBadRequestResponse
+	}
+	return &query, db.Order("created_at DESC, order_id DESC"), nil
+}
+
+func searchOrders(c echo.Context) error {
+	query, db, err := bindOrderSearch(c)
+	if err != nil {
+		return err
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultOrderSearchLimit
+	}
+
+	if query.Cursor != "" {
+		createdAt, orderId, err := decodeOrderCursor(query.Cursor)
+		if err != nil {
+			requestLog(c, LogDb).Errorf("decode cursor error: %v", err)
+			return NewErrorResponse(http.StatusBadRequest, ErrorMessageCursorInvalid)
+		}
+		db = db.Where("created_at < ? OR (created_at = ? AND order_id < ?)", createdAt, createdAt, orderId)
+	}
+
+	// one more order tells if there is a next page
+	var orders []Order
+	if err := db.Limit(query.Limit + 1).Find(&orders).Error; err != nil {
+		requestLog(c, LogDb).Errorf("search orders error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	response := OrderSearchResponse{Orders: make([]AdminOrder, 0, len(orders))}
+	if len(orders) > query.Limit {
+		orders = orders[:query.Limit]
+		response.NextCursor = encodeOrderCursor(&orders[len(orders)-1])
+	}
+	for _, order := range orders {
+		response.Orders = append(response.Orders, newAdminOrder(order))
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// searchNotifications lists the latest payment notifications with a result, so that the admins could
+// look into the conflicting ones, which have been paid but could not be settled
+func searchNotifications(c echo.Context) error {
+	var query NotificationSearchRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogDb).Warnf("bind query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil {
+		requestLog(c, LogDb).Warnf("validate query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if query.Result == "" {
+		query.Result = NotificationResultConflict
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultNotificationSearchLimit
+	}
+
+	notifications := []PaymentNotification{}
+	err := WebData.Where("result = ?", query.Result).
+		Order("received_at DESC").
+		Limit(query.Limit).
+		Find(&notifications).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("find payment notifications error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return c.JSON(http.StatusOK, notifications)
+}
+
+func getOrderDetail(c echo.Context) error {
+	var order Order
+	err := WebData.Where("order_id = ?", c.Param("orderId")).First(&order).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return NewErrorResponse(http.StatusNotFound, ErrorMessageOrderNotFound)
+	} else if err != nil {
+		requestLog(c, LogDb).Errorf("find order error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	response := OrderDetailResponse{Order: newAdminOrder(order)}
+
+	// notifications of cashier orders may have arrived before the aoid was known
+	err = WebData.Where("order_id = ? OR platform_order_id = ?", order.OrderID, order.PlatformOrderID).
+		Order("received_at ASC").
+		Find(&response.Notifications).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("find payment notifications error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	err = WebData.Where("order_id = ?", order.OrderID).
+		Order("attempted_at ASC").
+		Find(&response.DeliveryAttempts).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("find delivery attempts error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	var paidOrder PaidOrder
+	err = GameData.Where("order_id = ?", order.OrderID).First(&paidOrder).Error
+	if err == nil {
+		response.PaidOrder = &paidOrder
+	} else if !gorm.IsRecordNotFoundError(err) {
+		requestLog(c, LogDb).Errorf("find paid order error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func orderExportRow(order *Order) []string {
+	return []string{
+		order.OrderID,
+		order.PlatformOrderID,
+		order.ParentUsername,
+		order.Status,
+		order.PayType,
+		strconv.FormatUint(order.PaidPrice, 10),
+		strconv.FormatUint(order.DiscountPrice, 10),
+		strconv.FormatUint(order.BonusCoins, 10),
+		order.CouponCode,
+		order.PromotionID,
+		order.TransactionID,
+		order.TransactionType,
+		order.ClientIP,
+		order.CreatedAt.Format(time.RFC3339),
+		formatOptionalTime(order.PaidAt),
+		formatOptionalTime(order.ProcessedAt),
+		strconv.FormatUint(order.RefundPrice, 10),
+		formatOptionalTime(order.RefundedAt),
+		order.ReviewReason,
+	}
+}
+
+// exportOrders writes the orders matching the search as csv or xlsx, ignoring the cursor
+func exportOrders(c echo.Context) error {
+	query, db, err := bindOrderSearch(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Limit(OrderExportMaxRows).Rows()
+	if err != nil {
+		requestLog(c, LogDb).Errorf("find orders error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	defer rows.Close()
+
+	if query.Format == OrderExportFormatXLSX {
+		sheet := "Sheet1"
+		file := excelize.NewFile()
+		header := make([]interface{}, len(orderExportHeader))
+		for i, v := range orderExportHeader {
+			header[i] = v
+		}
+		file.SetSheetRow(sheet, "A1", &header)
+		for row := 2; rows.Next(); row++ {
+			var order Order
+			if err := WebData.ScanRows(rows, &order); err != nil {
+				requestLog(c, LogDb).Errorf("scan order error: %v", err)
+				return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+			}
+			fields := orderExportRow(&order)
+			values := make([]interface{}, len(fields))
+			for i, v := range fields {
+				values[i] = v
+			}
+			file.SetSheetRow(sheet, fmt.Sprintf("A%d", row), &values)
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="orders.xlsx"`)
+		c.Response().WriteHeader(http.StatusOK)
+		return file.Write(c.Response())
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="orders.csv"`)
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(c.Response())
+	_ = w.Write(orderExportHeader)
+	for rows.Next() {
+		var order Order
+		if err := WebData.ScanRows(rows, &order); err != nil {
+			requestLog(c, LogDb).Errorf("scan order error: %v", err)
+			break
+		}
+		_ = w.Write(orderExportRow(&order))
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditActionLogin         = "user.login"
+	AuditActionLoginFailed   = "user.login_failed"
+	AuditActionLogout        = "user.logout"
+	AuditActionAdminLogin    = "admin.login"
+	AuditActionPlaceOrder    = "order.place"
+	AuditActionNotify        = "order.notify"
+	AuditActionRefund        = "order.refund"
+	AuditActionMarkPaid      = "order.mark_paid"
+	AuditActionRetryDelivery = "order.retry_delivery"
+	AuditActionMarkDelivered = "order.mark_delivered"
+	AuditActionCancel        = "order.cancel"
+	AuditActionCompensate    = "user.compensate"
+	AuditActionProtect       = "user.protect"
+	AuditActionUnprotect     = "user.unprotect"
+	AuditActionGrantRole     = "admin.grant_role"
+	AuditActionRevokeRole    = "admin.revoke_role"
+	AuditActionCreateAccount = "admin.create_account"
+	AuditActionDeleteAccount = "admin.delete_account"
+	AuditActionCoupons       = "coupon.generate"
+	AuditActionRevokeTokens  = "user.revoke_tokens"
+
+	// AuditActorPaymentPlatform is the actor of the notifications sent by the payment platform
+	AuditActorPaymentPlatform = "xorpay"
+	// AuditActorCLI prefixes the system user running a command line action
+	AuditActorCLI = "cli:"
+
+	DefaultAuditQueryLimit = 100
+	// AuditUserAgentLength is the length of the user_agent column, in characters
+	AuditUserAgentLength = 512
+)
+
+var (
+	// auditMutex serializes the appends within this process; the row lock of the chain head covers the other processes
+	auditMutex sync.Mutex
+)
+
+// AuditEntry records an action taken by an actor, with the snapshots of its target before and after.
+// Every entry is chained to the previous one by including its hash, so that an entry could not be altered
+// or removed without breaking the hashes of all the entries after it.
+type AuditEntry struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	Actor     string    `gorm:"size:255;index;NOT NULL" json:"actor"`
+	Action    string    `gorm:"size:64;index;NOT NULL" json:"action"`
+	Target    string    `gorm:"size:255;index" json:"target"`
+	Reason    string    `gorm:"size:255" json:"reason"`
+	IP        string    `gorm:"size:64" json:"ip"`
+	UserAgent string    `gorm:"size:512" json:"user_agent"`
+	Before    string    `gorm:"type:text" json:"before"`
+	After     string    `gorm:"type:text" json:"after"`
+	CreatedAt time.Time `gorm:"index;NOT NULL" json:"created_at"`
+	PrevHash  string    `gorm:"size:64;NOT NULL" json:"prev_hash"`
+	Hash      string    `gorm:"size:64;unique_index;NOT NULL" json:"hash"`
+}
+
+// AuditQueryRequest filters the audit entries. From and To are dates formatted as 2006-01-02,
+// Before is the smallest id of the previous page.
+type AuditQueryRequest struct {
+	Actor  string `query:"actor" validate:"max=255"`
+	Action string `query:"action" validate:"max=64"`
+	Target string `query:"target" validate:"max=255"`
+	From   string `query:"from" validate:"omitempty,len=10"`
+	To     string `query:"to" validate:"omitempty,len=10"`
+	Before uint   `query:"before"`
+	Limit  int    `query:"limit" validate:"omitempty,min=1,max=1000"`
+}
+
+// AuditVerification is the outcome of checking the whole hash chain
+type AuditVerification struct {
+	Checked uint `json:"checked"`
+	Valid   bool `json:"valid"`
+	// BrokenAt is the id of the first entry which does not match its hash or its predecessor
+	BrokenAt uint   `json:"broken_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// computeHash hashes the content of the entry together with the hash of its predecessor.
+// CreatedAt is hashed in seconds, the precision kept by the database.
+func (e *AuditEntry) computeHash() string {
+	content, _ := json.Marshal([]string{
+		e.PrevHash,
+		e.Actor,
+		e.Action,
+		e.Target,
+		e.Reason,
+		e.IP,
+		e.UserAgent,
+		e.Before,
+		e.After,
+		strconv.FormatInt(e.CreatedAt.Unix(), 10),
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func auditSnapshot(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// truncateRunes cuts s to max characters, replacing the bytes which are not valid utf-8,
+// so that the value hashed is the one the database stores and returns
+func truncateRunes(s string, max int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == max {
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// appendAuditEntry chains entry to the last one and stores it
+func appendAuditEntry(entry *AuditEntry) error {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	tx := WebData.Begin()
+	var head AuditEntry
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Order("id DESC").First(&head).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		tx.Rollback()
+		return err
+	}
+
+	entry.PrevHash = head.Hash
+	entry.CreatedAt = time.Now().Truncate(time.Second)
+	entry.Hash = entry.computeHash()
+	if err = tx.Create(entry).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// auditAs records action taken by actor on target, along with the client of the request.
+// Failing to record is logged but does not fail the action, which has happened already.
+func auditAs(c echo.Context, actor string, action string, target string, reason string, before interface{}, after interface{}) {
+	entry := AuditEntry{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		Reason:    reason,
+		IP:        c.RealIP(),
+		UserAgent: truncateRunes(c.Request().UserAgent(), AuditUserAgentLength),
+		Before:    auditSnapshot(before),
+		After:     auditSnapshot(after),
+	}
+	if err := appendAuditEntry(&entry); err != nil {
+		requestLog(c, LogDb).Errorf("save audit entry %s on %s error: %v", action, target, err)
+	}
+}
+
+// cliActor names the system user running the command line
+func cliActor() string {
+	if current, err := user.Current(); err == nil {
+		return AuditActorCLI + current.Username
+	}
+	return AuditActorCLI + os.Getenv("USER")
+}
+
+// auditFromCLI records action taken on target by the operator running a command
+func auditFromCLI(action string, target string, reason string, before interface{}, after interface{}) {
+	entry := AuditEntry{
+		Actor:  cliActor(),
+		Action: action,
+		Target: target,
+		Reason: reason,
+		Before: auditSnapshot(before),
+		After:  auditSnapshot(after),
+	}
+	if err := appendAuditEntry(&entry); err != nil {
+		LogDb.Errorf("save audit entry %s on %s error: %v", action, target, err)
+	}
+}
+
+// audit records action taken by the user of the request on target
+func audit(c echo.Context, action string, target string, reason string, before interface{}, after interface{}) {
+	auditAs(c, c.Get("token").(*Token).ParentUsername, action, target, reason, before, after)
+}
+
+// checkAuditEntry tells why entry is not chained to the entry hashed prevHash, or returns an empty string if it is
+func checkAuditEntry(entry *AuditEntry, prevHash string) string {
+	switch {
+	case entry.PrevHash != prevHash:
+		return fmt.Sprintf("entry %d does not follow the previous entry", entry.ID)
+	case entry.computeHash() != entry.Hash:
+		return fmt.Sprintf("entry %d does not match its hash", entry.ID)
+	default:
+		return ""
+	}
+}
+
+// verifyAuditLog walks the whole audit log in order, recomputing every hash
+func verifyAuditLog() (*AuditVerification, error) {
+	rows, err := WebData.Model(&AuditEntry{}).Order("id ASC").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := AuditVerification{Valid: true}
+	prevHash := ""
+	for rows.Next() {
+		var entry AuditEntry
+		if err := WebData.ScanRows(rows, &entry); err != nil {
+			return nil, err
+		}
+		result.Checked++
+
+		if result.Error = checkAuditEntry(&entry, prevHash); result.Error != "" {
+			result.Valid = false
+			result.BrokenAt = entry.ID
+			return &result, nil
+		}
+		prevHash = entry.Hash
+	}
+	return &result, rows.Err()
+}
+
+func queryAuditLog(c echo.Context) error {
+	var query AuditQueryRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogDb).Warnf("bind query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil {
+		requestLog(c, LogDb).Warnf("validate query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if query.Limit == 0 {
+		query.Limit = DefaultAuditQueryLimit
+	}
+
+	db := WebData.Order("id DESC").Limit(query.Limit)
+	for _, field := range []struct {
+		value     string
+		condition string
+	}{
+		{query.Actor, "actor = ?"},
+		{query.Action, "action = ?"},
+		{query.Target, "target = ?"},
+	} {
+		if field.value != "" {
+			db = db.Where(field.condition, field.value)
+		}
+	}
+	for _, bound := range []struct {
+		date      string
+		condition string
+	}{
+		{query.From, "created_at >= ?"},
+		{query.To, "created_at < ?"},
+	} {
+		if bound.date == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", bound.date, Timezone)
+		if err != nil {
+			return DefaultBadRequestResponse
+		}
+		db = db.Where(bound.condition, t)
+	}
+	if query.Before != 0 {
+		db = db.Where("id < ?", query.Before)
+	}
+
+	entries := []AuditEntry{}
+	if err := db.Find(&entries).Error; err != nil {
+		requestLog(c, LogDb).Errorf("find audit entries error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+func verifyAuditLogNow(c echo.Context) error {
+	result, err := verifyAuditLog()
+	if err != nil {
+		requestLog(c, LogDb).Errorf("verify audit log error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// testAuditChain chains three entries the way appendAuditEntry does
+func testAuditChain() []AuditEntry {
+	createdAt := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	entries := []AuditEntry{
+		{ID: 1, Actor: "Steve", Action: AuditActionRefund, Target: "order:A1", Reason: "duplicated payment", IP: "10.0.0.1"},
+		{ID: 2, Actor: "Alex", Action: AuditActionRefund, Target: "order:B2", Reason: "客户要求退款", Before: `{"status":"delivered"}`},
+		{ID: 3, Actor: AuditActorCLI + "root", Action: AuditActionRefund, Target: "order:C3", After: `{"status":"refunded"}`},
+	}
+	prevHash := ""
+	for i := range entries {
+		entries[i].PrevHash = prevHash
+		entries[i].CreatedAt = createdAt.Add(time.Duration(i) * time.Minute)
+		entries[i].Hash = entries[i].computeHash()
+		prevHash = entries[i].Hash
+	}
+	return entries
+}
+
+// brokenAuditEntry returns the id of the first entry of the chain failing checkAuditEntry, or 0 if none does
+func brokenAuditEntry(entries []AuditEntry) uint {
+	prevHash := ""
+	for i := range entries {
+		if checkAuditEntry(&entries[i], prevHash) != "" {
+			return entries[i].ID
+		}
+		prevHash = entries[i].Hash
+	}
+	return 0
+}
+
+func TestAuditChain(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(entries []AuditEntry) []AuditEntry
+		brokenAt uint
+	}{
+		{"untouched", func(entries []AuditEntry) []AuditEntry {
+			return entries
+		}, 0},
+		{"altered reason", func(entries []AuditEntry) []AuditEntry {
+			entries[1].Reason = "mistake"
+			return entries
+		}, 2},
+		{"altered snapshot", func(entries []AuditEntry) []AuditEntry {
+			entries[2].After = `{"status":"cancelled"}`
+			return entries
+		}, 3},
+		{"altered time", func(entries []AuditEntry) []AuditEntry {
+			entries[0].CreatedAt = entries[0].CreatedAt.Add(time.Second)
+			return entries
+		}, 1},
+		{"altered and rehashed", func(entries []AuditEntry) []AuditEntry {
+			entries[1].Actor = "Herobrine"
+			entries[1].Hash = entries[1].computeHash()
+			return entries
+		}, 3},
+		{"removed", func(entries []AuditEntry) []AuditEntry {
+			return append(entries[:1], entries[2:]...)
+		}, 3},
+		{"reordered", func(entries []AuditEntry) []AuditEntry {
+			entries[1], entries[2] = entries[2], entries[1]
+			return entries
+		}, 3},
+		{"removed head", func(entries []AuditEntry) []AuditEntry {
+			return entries[1:]
+		}, 2},
+	}
+	for _, test := range tests {
+		if got := brokenAuditEntry(test.tamper(testAuditChain())); got != test.brokenAt {
+			t.Errorf("%s: broken at %d, want %d", test.name, got, test.brokenAt)
+		}
+	}
+}
+
+func TestAuditHashPrecision(t *testing.T) {
+	entry := testAuditChain()[0]
+	// the database keeps the seconds only
+	entry.CreatedAt = entry.CreatedAt.Add(400 * time.Millisecond)
+	if checkAuditEntry(&entry, "") != "" {
+		t.Errorf("entry with the time stored in seconds does not match its hash")
+	}
+
+	// the fields are hashed apart, so that moving characters across them changes the hash
+	moved := testAuditChain()[0]
+	moved.Actor, moved.Action = moved.Actor+moved.Action[:1], moved.Action[1:]
+	if moved.computeHash() == moved.Hash {
+		t.Errorf("moving characters from the action to the actor keeps the hash")
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		max  int
+		want string
+	}{
+		{"short", "Mozilla/5.0", 512, "Mozilla/5.0"},
+		{"ascii", "Mozilla/5.0", 7, "Mozilla"},
+		{"multi-byte", "浮梦之境充值", 4, "浮梦之境"},
+		{"multi-byte kept whole", "a浮b", 2, "a浮"},
+		{"emoji", "💰💰💰", 2, "💰💰"},
+		{"invalid utf-8", "ab\xffcd", 10, "ab\ufffdcd"},
+		{"invalid utf-8 counted", "\xff\xfeabc", 3, "\ufffd\ufffda"},
+		{"cut sequence", "ab\xe6\xb5", 10, "ab\ufffd\ufffd"},
+		{"empty", "", 10, ""},
+		{"zero", "abc", 0, ""},
+	}
+	for _, test := range tests {
+		got := truncateRunes(test.s, test.max)
+		if got != test.want {
+			t.Errorf("%s: truncateRunes(%q, %d) = %q, want %q", test.name, test.s, test.max, got, test.want)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: truncateRunes(%q, %d) = %q is not valid utf-8", test.name, test.s, test.max, got)
+		}
+	}
+
+	long := strings.Repeat("浮", AuditUserAgentLength+1)
+	if got := utf8.RuneCountInString(truncateRunes(long, AuditUserAgentLength)); got != AuditUserAgentLength {
+		t.Errorf("truncated user agent has %d characters, want %d", got, AuditUserAgentLength)
+	}
+}
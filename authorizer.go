@@ -13,11 +13,27 @@ const (
 	ErrorMessageNeedAuthorization = "需要身份验证"
 	ErrorMessageSessionExpired    = "用户会话已过期"
 	ErrorMessageTokenSaveError    = "用户密钥延期失败"
+	ErrorMessageNeedAdmin         = "需要管理员权限"
+	ErrorMessageNeedPlayer        = "管理员账号无法进行此操作"
 
 	TokenLifetime = time.Hour * 24
 )
 
+// needValidation only allows the players logged in, whose tokens are issued by validateUser
 func needValidation(next echo.HandlerFunc) echo.HandlerFunc {
+	return needToken(func(c echo.Context) error {
+		username := c.Get("token").(*Token).ParentUsername
+		if strings.HasPrefix(username, AdminAccountPrefix) {
+			// the admin accounts are not players, so that they could not order or redeem coins for themselves
+			requestLog(c, LogAuth).Warnf("admin account %s attempted to access %s", username, c.Path())
+			return NewErrorResponse(http.StatusForbidden, ErrorMessageNeedPlayer)
+		}
+		return next(c)
+	})
+}
+
+// needToken allows any valid token, of the players as well as of the admin accounts, and extends its lifetime
+func needToken(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		credentials := c.Request().Header.Get("authorization")
 		userToken := strings.TrimPrefix(credentials, "Bearer ")
@@ -26,9 +42,9 @@ func needValidation(next echo.HandlerFunc) echo.HandlerFunc {
 		}
 
 		var token Token
-		err := WebData.Debug().Where("token = ?", userToken).First(&token).Error
+		err := WebData.Where("token = ?", userToken).First(&token).Error
 		if err != nil {
-			LogAuth.Printf("validate token error: %v", err)
+			requestLog(c, LogAuth).Errorf("validate token error: %v", err)
 			return NewErrorResponse(http.StatusUnauthorized, ErrorMessageNeedAuthorization)
 		}
 
@@ -46,14 +62,14 @@ func needValidation(next echo.HandlerFunc) echo.HandlerFunc {
 
 		if token.ExpireAt.Before(time.Now()) {
 			WebData.Delete(token)
-			LogAuth.Printf("token outdated for: %v", token)
+			requestLog(c, LogAuth).Infof("token of %s outdated", token.ParentUsername)
 			return NewErrorResponse(http.StatusUpgradeRequired, ErrorMessageSessionExpired)
 		}
 
 		token.ExpireAt = time.Now().Add(TokenLifetime)
 		err = WebData.Save(&token).Error
 		if err != nil {
-			LogAuth.Printf("save token error: %v", err)
+			requestLog(c, LogAuth).Errorf("save token error: %v", err)
 			return NewErrorResponse(http.StatusUnauthorized, ErrorMessageTokenSaveError)
 		}
 
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// NeedNothing commands run without the config
+	NeedNothing = iota
+	// NeedConfig commands run with the config loaded
+	NeedConfig
+	// NeedDatabases commands run with the components initialized and the databases connected
+	NeedDatabases
+
+	DefaultKeyBits = 2048
+)
+
+// Command is a subcommand of the binary, named by one or two words such as `serve` or `token revoke`
+type Command struct {
+	Name    string
+	Summary string
+	Needs   int
+	Run     func(config *Config, args []string) error
+}
+
+var commands []Command
+
+func init() {
+	commands = []Command{
+		{"serve", "serve the api and the frontend until terminated (default)", NeedDatabases, runServe},
+		{"migrate", "apply the pending database migrations", NeedDatabases, runMigrate},
+		{"migrate down", "revert the last database migrations", NeedDatabases, runMigrateDown},
+		{"migrate status", "list the database migrations and whether they are applied", NeedDatabases, runMigrationStatus},
+		{"reconcile", "reconcile the unpaid orders against the payment platform", NeedDatabases, runReconcile},
+		{"deliver", "deliver a paid order into the game database", NeedDatabases, runDeliver},
+		{"token revoke", "sign a user out everywhere", NeedDatabases, runRevokeTokens},
+		{"admin grant-role", "grant an admin role to a user", NeedDatabases, runGrantRole},
+		{"audit verify", "verify the hash chain of the audit log", NeedDatabases, runVerifyAudit},
+		{"coupons generate", "generate a batch of coupons", NeedDatabases, runGenerateCoupons},
+		{"keygen", "generate the RSA key pair of the encrypted forms", NeedNothing, runKeygen},
+		{"config check", "validate the config file and the environment overrides", NeedConfig, runCheckConfig},
+	}
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [-config config.yml] <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, command := range commands {
+		fmt.Fprintf(out, "  %-18s %s\n", command.Name, command.Summary)
+	}
+	fmt.Fprintf(out, "\nRun `%s <command> -h` for the flags of a command.\n\nGlobal flags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// findCommand matches the longest command name at the beginning of args, returning the remaining args
+func findCommand(args []string) (*Command, []string) {
+	var found *Command
+	var rest []string
+	for i := range commands {
+		words := strings.Fields(commands[i].Name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != commands[i].Name {
+			continue
+		}
+		if found == nil || len(words) > len(strings.Fields(found.Name)) {
+			found = &commands[i]
+			rest = args[len(words):]
+		}
+	}
+	return found, rest
+}
+
+// runCommand prepares what the command named by args needs and runs it; serve is run without args
+func runCommand(args []string) error {
+	if len(args) == 0 {
+		args = []string{"serve"}
+	}
+	command, rest := findCommand(args)
+	if command == nil {
+		printUsage()
+		return fmt.Errorf("unknown command `%s`", strings.Join(args, " "))
+	}
+
+	var config *Config
+	if command.Needs >= NeedConfig {
+		var err error
+		if config, err = loadConfig(ConfigFile); err != nil {
+			return err
+		}
+	}
+	if command.Needs >= NeedDatabases {
+		err := initComponents(config)
+		if PaySandbox != nil {
+			defer PaySandbox.Close()
+		}
+		if err != nil {
+			return err
+		}
+		err = openDatabases(config)
+		defer closeDatabases()
+		if err != nil {
+			return err
+		}
+	}
+	return command.Run(config, rest)
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// requireFlags fails if any of the string flags named is left empty
+func requireFlags(flags *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if flags.Lookup(name).Value.String() == "" {
+			return fmt.Errorf("flag -%s is required", name)
+		}
+	}
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func runServe(config *Config, args []string) error {
+	if err := newFlagSet("serve").Parse(args); err != nil {
+		return err
+	}
+	if config.Database.MigrateOnStart {
+		if err := migrateDatabases(); err != nil {
+			return err
+		}
+	} else if pending, err := pendingMigrations(WebData, WebMigrations); err != nil {
+		return errors.Wrap(err, "check migrations error")
+	} else if pending != 0 {
+		LogDb.Warnf("%d migrations pending, run the migrate command", pending)
+	}
+	return serve(config)
+}
+
+func runMigrate(config *Config, args []string) error {
+	if err := newFlagSet("migrate").Parse(args); err != nil {
+		return err
+	}
+	if err := migrateDatabases(); err != nil {
+		return err
+	}
+	LogDb.Info("databases migrated")
+	return nil
+}
+
+func runMigrateDown(config *Config, args []string) error {
+	flags := newFlagSet("migrate down")
+	steps := flags.Int("steps", 1, "number of migrations to revert")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *steps < 1 {
+		return fmt.Errorf("flag -steps must be positive")
+	}
+
+	reverted, err := migrateDown(WebData, WebMigrations, *steps)
+	if err != nil {
+		return errors.Wrap(err, "revert migrations error")
+	}
+	LogDb.Infof("%d migrations reverted", reverted)
+	return nil
+}
+
+func runMigrationStatus(config *Config, args []string) error {
+	if err := newFlagSet("migrate status").Parse(args); err != nil {
+		return err
+	}
+	statuses, err := migrationStatus(WebData, WebMigrations)
+	if err != nil {
+		return errors.Wrap(err, "check migrations error")
+	}
+	for _, status := range statuses {
+		fmt.Println(status)
+	}
+	return nil
+}
+
+func runReconcile(config *Config, args []string) error {
+	flags := newFlagSet("reconcile")
+	window := flags.Duration("window", DefaultReconcileWindow, "reconcile the orders created within `duration`")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := reconcileOrders(context.Background(), time.Now().Add(-*window))
+	if err != nil {
+		return errors.Wrap(err, "reconcile orders error")
+	}
+	return printJSON(report)
+}
+
+func runDeliver(config *Config, args []string) error {
+	flags := newFlagSet("deliver")
+	orderId := flags.String("order", "", "`id` of the order to deliver")
+	reason := flags.String("reason", "", "why the order is delivered by hand, recorded in the audit log")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(flags, "order", "reason"); err != nil {
+		return err
+	}
+
+	var order Order
+	if err := WebData.Where("order_id = ?", *orderId).First(&order).Error; gorm.IsRecordNotFoundError(err) {
+		return fmt.Errorf("order %s not found", *orderId)
+	} else if err != nil {
+		return errors.Wrap(err, "find order error")
+	}
+	if order.Status != OrderStatusPaid && order.Status != OrderStatusHeld {
+		return fmt.Errorf("order %s is %s, only paid and held orders could be delivered", order.OrderID, order.Status)
+	}
+
+	before := newAdminOrder(order)
+	if err := deliverOrder(&order); err != nil {
+		return errors.Wrapf(err, "deliver order %s error", order.OrderID)
+	}
+	auditFromCLI(AuditActionRetryDelivery, "order:"+order.OrderID, *reason, before, newAdminOrder(order))
+	return printJSON(newAdminOrder(order))
+}
+
+func runRevokeTokens(config *Config, args []string) error {
+	flags := newFlagSet("token revoke")
+	username := flags.String("user", "", "`username` to sign out, or an admin account prefixed by "+AdminAccountPrefix)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(flags, "user"); err != nil {
+		return err
+	}
+
+	result := WebData.Where("parent_username = ?", *username).Delete(&Token{})
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "delete tokens error")
+	}
+	auditFromCLI(AuditActionRevokeTokens, "user:"+*username, "", nil, map[string]int64{"revoked": result.RowsAffected})
+	LogAuth.Infof("%d tokens of %s revoked", result.RowsAffected, *username)
+	return nil
+}
+
+func runGrantRole(config *Config, args []string) error {
+	flags := newFlagSet("admin grant-role")
+	username := flags.String("user", "", "`username` to grant the role to, or an admin account prefixed by "+AdminAccountPrefix)
+	role := flags.String("role", "", "one of viewer, support, finance and superadmin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := requireFlags(flags, "user", "role"); err != nil {
+		return err
+	}
+	if _, ok := rolePermissions[*role]; !ok {
+		return fmt.Errorf("unknown role %s", *role)
+	}
+
+	granted := AdminRole{
+		Username:  *username,
+		Role:      *role,
+		GrantedBy: cliActor(),
+		GrantedAt: time.Now(),
+	}
+	if err := WebData.Save(&granted).Error; err != nil {
+		return errors.Wrap(err, "save admin role error")
+	}
+	auditFromCLI(AuditActionGrantRole, "user:"+granted.Username, "", nil, granted)
+	LogAuth.Infof("role %s granted to %s", granted.Role, granted.Username)
+	return nil
+}
+
+func runVerifyAudit(config *Config, args []string) error {
+	if err := newFlagSet("audit verify").Parse(args); err != nil {
+		return err
+	}
+	result, err := verifyAuditLog()
+	if err != nil {
+		return errors.Wrap(err, "verify audit log error")
+	}
+	if !result.Valid {
+		return fmt.Errorf("audit log broken after %d entries: %s", result.Checked, result.Error)
+	}
+	LogDb.Infof("audit log intact, %d entries checked", result.Checked)
+	return nil
+}
+
+func runGenerateCoupons(config *Config, args []string) error {
+	flags := newFlagSet("coupons generate")
+	var form GenerateCouponsRequest
+	flags.StringVar(&form.Batch, "batch", "", "`name` of the batch")
+	flags.IntVar(&form.Count, "count", 1, "number of coupons")
+	flags.StringVar(&form.Type, "type", "", "one of fixed_discount, percent_discount and coin_grant")
+	flags.Uint64Var(&form.Value, "value", 0, "discount in yuan, percents or coins granted, depending on the type")
+	flags.UintVar(&form.MaxUses, "max-uses", 1, "uses of each coupon")
+	flags.UintVar(&form.UserLimit, "user-limit", 1, "uses of each coupon by the same user")
+	expire := flags.String("expire", "", "`date` formatted as 2006-01-02 when the coupons expire, in the server timezone")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *expire != "" {
+		expireAt, err := time.ParseInLocation("2006-01-02", *expire, Timezone)
+		if err != nil {
+			return errors.Wrap(err, "parse -expire error")
+		}
+		form.ExpireAt = &expireAt
+	}
+	if err := validator.New().Struct(&form); err != nil {
+		return err
+	}
+
+	coupons, err := generateCoupons(form.Batch, form.Count, Coupon{
+		Type:      form.Type,
+		Value:     form.Value,
+		MaxUses:   form.MaxUses,
+		UserLimit: form.UserLimit,
+		ExpireAt:  form.ExpireAt,
+	})
+	if err != nil {
+		return errors.Wrap(err, "generate coupons error")
+	}
+	auditFromCLI(AuditActionCoupons, "batch:"+form.Batch, "", nil, map[string]interface{}{
+		"type":  form.Type,
+		"value": form.Value,
+		"count": len(coupons),
+	})
+	for _, coupon := range coupons {
+		fmt.Println(coupon.Code)
+	}
+	return nil
+}
+
+// runKeygen writes a new RSA private key in the PKCS #1 PEM read by NewDecryptor, and its public key next to it
+func runKeygen(config *Config, args []string) error {
+	flags := newFlagSet("keygen")
+	out := flags.String("out", "private.pem", "`file` of the private key; the public key is written to file.pub")
+	bits := flags.Int("bits", DefaultKeyBits, "size of the key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return errors.Wrap(err, "generate key error")
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "marshal public key error")
+	}
+
+	for _, file := range []struct {
+		name  string
+		mode  os.FileMode
+		block *pem.Block
+	}{
+		{*out, 0600, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}},
+		{*out + ".pub", 0644, &pem.Block{Type: "PUBLIC KEY", Bytes: public}},
+	} {
+		// never overwrite a key in use
+		f, err := os.OpenFile(file.name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.mode)
+		if err != nil {
+			return err
+		}
+		err = pem.Encode(f, file.block)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "write %s error", file.name)
+		}
+		fmt.Println(file.name)
+	}
+	return nil
+}
+
+func runCheckConfig(config *Config, args []string) error {
+	flags := newFlagSet("config check")
+	connect := flags.Bool("connect", false, "also connect to the databases")
+	printConfig := flags.Bool("print", false, "print the config, secrets redacted, as overridden by the environment")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	err := initComponents(config)
+	if PaySandbox != nil {
+		PaySandbox.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if *connect {
+		err = openDatabases(config)
+		closeDatabases()
+		if err != nil {
+			return err
+		}
+	}
+	if *printConfig {
+		printed, err := redactConfig(config)
+		if err != nil {
+			return err
+		}
+		fmt.Print(printed)
+	}
+	LogDb.Info("config is valid")
+	return nil
+}
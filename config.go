@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"gopkg.in/go-playground/validator.v9"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// ConfigEnvPrefix prefixes the environment variables overriding the config, e.g. FLOATDREAM_XORPAY_APP_SECRET
+	// overrides xorpay.appSecret. Appending _FILE reads the value from a file instead, e.g. a Docker secret.
+	ConfigEnvPrefix = "FLOATDREAM"
+
+	// SandboxAppSecretPrefix marks the app secrets made up for the sandbox, which are the only ones accepted along with it
+	SandboxAppSecretPrefix = "sandbox"
+)
+
+// configKey is the yaml key of field, or empty if field is not configurable
+func configKey(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	if key == "" {
+		key = strings.ToLower(field.Name)
+	}
+	return key
+}
+
+// envName converts a yaml key such as cacheTTL into the CACHE_TTL part of an environment variable
+func envName(key string) string {
+	runes := []rune(key)
+	var name []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || (unicode.IsUpper(previous) && nextIsLower) {
+				name = append(name, '_')
+			}
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return string(name)
+}
+
+// configEnvName is the environment variable overriding the config at path, e.g. xorpay.appSecret
+func configEnvName(path string) string {
+	name := ConfigEnvPrefix
+	for _, key := range strings.Split(path, ".") {
+		name += "_" + envName(key)
+	}
+	return name
+}
+
+// lookupEnvOrFile finds the value of the environment variable name, or the content of the file named by name_FILE
+func lookupEnvOrFile(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	file, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimRight(string(content), "\r\n"), true, nil
+}
+
+// setConfigValue parses raw into value. Strings are taken as is, lists of strings could be separated by commas,
+// and the other values are parsed as yaml, e.g. 5m for a duration or [{name: child, forbidden: true}] for a list.
+func setConfigValue(value reflect.Value, raw string) error {
+	switch {
+	case value.Kind() == reflect.String:
+		value.SetString(raw)
+		return nil
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(raw, "["):
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items).Convert(value.Type()))
+		return nil
+	default:
+		parsed := reflect.New(value.Type())
+		if err := yaml.Unmarshal([]byte(raw), parsed.Interface()); err != nil {
+			return err
+		}
+		value.Set(parsed.Elem())
+		return nil
+	}
+}
+
+// applyEnvOverrides overrides every field of the struct v from its environment variable, named after prefix and
+// the yaml keys leading to the field
+func applyEnvOverrides(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := configKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		name := prefix + "_" + envName(key)
+		value := v.Field(i)
+		if value.Kind() == reflect.Struct && value.Type() != reflect.TypeOf(time.Time{}) {
+			if err := applyEnvOverrides(value, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok, err := lookupEnvOrFile(name)
+		if err != nil {
+			return errors.Wrapf(err, "read %s_FILE error", name)
+		}
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(value, raw); err != nil {
+			return errors.Wrapf(err, "parse %s error", name)
+		}
+	}
+	return nil
+}
+
+// validateConfig checks the fields tagged by validate, listing every invalid field along with its environment variable
+func validateConfig(config *Config) error {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(configKey)
+	err := validate.Struct(config)
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+
+	messages := make([]string, 0, len(validationErrors))
+	for _, e := range validationErrors {
+		path := strings.TrimPrefix(e.Namespace(), "Config.")
+		if e.Tag() == "required" {
+			messages = append(messages, fmt.Sprintf("%s is required, set it in the config file or %s", path, configEnvName(path)))
+		} else {
+			messages = append(messages, fmt.Sprintf("%s is invalid, expecting %s=%s", path, e.Tag(), e.Param()))
+		}
+	}
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(messages, "\n  "))
+}
+
+// validateSandbox refuses the sandbox along with a real payment platform, so that a production config could not
+// serve fake payments by mistake
+func validateSandbox(config *Config) error {
+	if !config.XorPay.Sandbox {
+		return nil
+	}
+	if config.XorPay.BaseURL != "" {
+		return errors.New("invalid config: xorpay.sandbox could not be enabled along with xorpay.baseUrl")
+	}
+	if !strings.HasPrefix(config.XorPay.AppSecret, SandboxAppSecretPrefix) {
+		return fmt.Errorf("invalid config: xorpay.sandbox requires a made up xorpay.appSecret starting with %q", SandboxAppSecretPrefix)
+	}
+	return nil
+}
+
+// redactConfigTree replaces the values of the sensitive keys of a yaml tree
+func redactConfigTree(node interface{}) interface{} {
+	switch value := node.(type) {
+	case yaml.MapSlice:
+		for i, item := range value {
+			key, _ := item.Key.(string)
+			if s, ok := item.Value.(string); ok && isSensitiveKey(key) && s != "" {
+				value[i].Value = RedactedValue
+			} else {
+				value[i].Value = redactConfigTree(item.Value)
+			}
+		}
+	case []interface{}:
+		for i := range value {
+			value[i] = redactConfigTree(value[i])
+		}
+	}
+	return node
+}
+
+// redactConfig formats config as yaml, without its secrets, passwords and tokens
+func redactConfig(config *Config) (string, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	var tree yaml.MapSlice
+	if err = yaml.Unmarshal(data, &tree); err != nil {
+		return "", err
+	}
+	data, err = yaml.Marshal(redactConfigTree(tree))
+	return string(data), err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"address", "ADDRESS"},
+		{"cacheTTL", "CACHE_TTL"},
+		{"appId", "APP_ID"},
+		{"appSecret", "APP_SECRET"},
+		{"allowOrigins", "ALLOW_ORIGINS"},
+		{"publicUrl", "PUBLIC_URL"},
+		{"authMe", "AUTH_ME"},
+		{"HTTPServer", "HTTP_SERVER"},
+		{"level2Size", "LEVEL2_SIZE"},
+	}
+	for _, test := range tests {
+		if got := envName(test.key); got != test.want {
+			t.Errorf("envName(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestConfigEnvName(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"xorpay.appSecret", "FLOATDREAM_XORPAY_APP_SECRET"},
+		{"stats.cacheTTL", "FLOATDREAM_STATS_CACHE_TTL"},
+		{"server.cors.allowOrigins", "FLOATDREAM_SERVER_CORS_ALLOW_ORIGINS"},
+		{"database.authMe.dsn", "FLOATDREAM_DATABASE_AUTH_ME_DSN"},
+	}
+	for _, test := range tests {
+		if got := configEnvName(test.path); got != test.want {
+			t.Errorf("configEnvName(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+}
+
+func TestSetConfigValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		raw   string
+		want  interface{}
+	}{
+		{"string", "", "a, b: c", "a, b: c"},
+		{"string list", []string(nil), "a, b,,c ", []string{"a", "b", "c"}},
+		{"empty string list", []string{"a"}, "", []string{}},
+		{"yaml string list", []string(nil), "[a, b]", []string{"a", "b"}},
+		{"duration", time.Duration(0), "5m", 5 * time.Minute},
+		{"int", 0, "512", 512},
+		{"bool", false, "true", true},
+		{"structs", []MinorGroup(nil), "[{name: child}]", []MinorGroup{{Name: "child"}}},
+	}
+	for _, test := range tests {
+		value := reflect.New(reflect.TypeOf(test.value)).Elem()
+		value.Set(reflect.ValueOf(test.value))
+		if err := setConfigValue(value, test.raw); err != nil {
+			t.Errorf("%s: setConfigValue(%q) error: %v", test.name, test.raw, err)
+			continue
+		}
+		if got := value.Interface(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: setConfigValue(%q) = %#v, want %#v", test.name, test.raw, got, test.want)
+		}
+	}
+
+	var duration time.Duration
+	if err := setConfigValue(reflect.ValueOf(&duration).Elem(), "five minutes"); err == nil {
+		t.Errorf("setConfigValue(%q) into a duration succeeded", "five minutes")
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "floatdream-config")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	if err = ioutil.WriteFile(secretFile, []byte("from-file\r\n"), 0600); err != nil {
+		t.Fatalf("write secret file: %v", err)
+	}
+
+	env := map[string]string{
+		"FLOATDREAM_XORPAY_APP_ID":             "4415",
+		"FLOATDREAM_XORPAY_APP_SECRET_FILE":    secretFile,
+		"FLOATDREAM_STATS_CACHE_TTL":           "5m",
+		"FLOATDREAM_SERVER_CORS_ALLOW_ORIGINS": "https://a.example, https://b.example",
+		"FLOATDREAM_QRCODE_SIZE":               "512",
+		// the variable takes precedence over its file
+		"FLOATDREAM_METRICS_TOKEN":      "from-env",
+		"FLOATDREAM_METRICS_TOKEN_FILE": secretFile,
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	var config Config
+	config.Server.Address = ":8080"
+	if err = applyEnvOverrides(reflect.ValueOf(&config).Elem(), ConfigEnvPrefix); err != nil {
+		t.Fatalf("applyEnvOverrides error: %v", err)
+	}
+
+	if config.XorPay.AppID != "4415" {
+		t.Errorf("xorpay.appId = %q, want %q", config.XorPay.AppID, "4415")
+	}
+	if config.XorPay.AppSecret != "from-file" {
+		t.Errorf("xorpay.appSecret = %q, want %q", config.XorPay.AppSecret, "from-file")
+	}
+	if config.Stats.CacheTTL != 5*time.Minute {
+		t.Errorf("stats.cacheTTL = %v, want %v", config.Stats.CacheTTL, 5*time.Minute)
+	}
+	origins := []string{"https://a.example", "https://b.example"}
+	if !reflect.DeepEqual(config.Server.CORS.AllowOrigins, origins) {
+		t.Errorf("server.cors.allowOrigins = %q, want %q", config.Server.CORS.AllowOrigins, origins)
+	}
+	if config.QRCode.Size != 512 {
+		t.Errorf("qrcode.size = %d, want %d", config.QRCode.Size, 512)
+	}
+	if config.Metrics.Token != "from-env" {
+		t.Errorf("metrics.token = %q, want %q", config.Metrics.Token, "from-env")
+	}
+	if config.Server.Address != ":8080" {
+		t.Errorf("server.address = %q, want it kept as %q", config.Server.Address, ":8080")
+	}
+}
+
+func TestApplyEnvOverridesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"FLOATDREAM_STATS_CACHE_TTL", "five minutes"},
+		{"FLOATDREAM_XORPAY_APP_SECRET_FILE", filepath.Join(os.TempDir(), "floatdream-missing-secret")},
+	}
+	for _, test := range tests {
+		os.Setenv(test.name, test.value)
+		var config Config
+		err := applyEnvOverrides(reflect.ValueOf(&config).Elem(), ConfigEnvPrefix)
+		os.Unsetenv(test.name)
+		if err == nil {
+			t.Errorf("applyEnvOverrides with %s=%q succeeded", test.name, test.value)
+		} else if !strings.Contains(err.Error(), strings.TrimSuffix(test.name, "_FILE")) {
+			t.Errorf("applyEnvOverrides error %q does not name %s", err, test.name)
+		}
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	var config Config
+	config.Server.Address = ":8080"
+	config.Database.Web.Source = "mysql"
+	config.Database.Web.DSN = "root:hunter2@tcp(localhost)/web"
+	config.ReCAPTCHA.Secret = "recaptcha-secret"
+	config.XorPay.AppID = "4415"
+	config.XorPay.AppSecret = "xorpay-secret"
+	config.Promotions = []Promotion{{Name: "launch"}}
+
+	redacted, err := redactConfig(&config)
+	if err != nil {
+		t.Fatalf("redactConfig error: %v", err)
+	}
+
+	for _, secret := range []string{"hunter2", "recaptcha-secret", "xorpay-secret"} {
+		if strings.Contains(redacted, secret) {
+			t.Errorf("redacted config contains %q:\n%s", secret, redacted)
+		}
+	}
+
+	var parsed Config
+	if err = yaml.Unmarshal([]byte(redacted), &parsed); err != nil {
+		t.Fatalf("parse redacted config error: %v", err)
+	}
+	tests := []struct {
+		path string
+		got  string
+		want string
+	}{
+		{"database.web.dsn", parsed.Database.Web.DSN, RedactedValue},
+		{"recaptcha.secret", parsed.ReCAPTCHA.Secret, RedactedValue},
+		{"xorpay.appSecret", parsed.XorPay.AppSecret, RedactedValue},
+		// empty secrets are left empty, to tell them from the ones set
+		{"database.game.dsn", parsed.Database.Game.DSN, ""},
+		{"metrics.token", parsed.Metrics.Token, ""},
+		{"server.address", parsed.Server.Address, ":8080"},
+		{"database.web.source", parsed.Database.Web.Source, "mysql"},
+		{"xorpay.appId", parsed.XorPay.AppID, "4415"},
+	}
+	for _, test := range tests {
+		if test.got != test.want {
+			t.Errorf("redacted %s = %q, want %q", test.path, test.got, test.want)
+		}
+	}
+	if len(parsed.Promotions) != 1 || parsed.Promotions[0].Name != "launch" {
+		t.Errorf("redacted promotions = %+v, want the one named launch", parsed.Promotions)
+	}
+}
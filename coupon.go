@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"github.com/dchest/uniuri"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	CouponTypeFixedDiscount   = "fixed_discount"
+	CouponTypePercentDiscount = "percent_discount"
+	CouponTypeCoinGrant       = "coin_grant"
+
+	CouponCodeLength = 16
+
+	ErrorMessageCouponNotFound     = "兑换码不存在"
+	ErrorMessageCouponExpired      = "兑换码已过期"
+	ErrorMessageCouponExhausted    = "兑换码已被使用完"
+	ErrorMessageCouponUserLimit    = "已达到该兑换码的使用次数上限"
+	ErrorMessageCouponNotGift      = "该兑换码为优惠码，请在下单时使用"
+	ErrorMessageCouponNotDiscount  = "该兑换码为礼品码，请在兑换页面使用"
+	ErrorMessageCouponRedeemFailed = "兑换失败，稍后请重试"
+)
+
+var (
+	// CouponCodeCharCandidates omits characters which are easily confused with each other, such as 0/O and 1/I
+	CouponCodeCharCandidates = []byte("ABCDEFGHJKLMNPQRSTUVWXYZ23456789")
+
+	ErrCouponNotFound    = errors.New("coupon not found")
+	ErrCouponExpired     = errors.New("coupon expired")
+	ErrCouponExhausted   = errors.New("coupon exhausted")
+	ErrCouponUserLimit   = errors.New("coupon per-user limit reached")
+	ErrCouponNotGift     = errors.New("coupon is not a gift code")
+	ErrCouponNotDiscount = errors.New("coupon is not a discount code")
+
+	couponErrorMessages = map[error]string{
+		ErrCouponNotFound:    ErrorMessageCouponNotFound,
+		ErrCouponExpired:     ErrorMessageCouponExpired,
+		ErrCouponExhausted:   ErrorMessageCouponExhausted,
+		ErrCouponUserLimit:   ErrorMessageCouponUserLimit,
+		ErrCouponNotGift:     ErrorMessageCouponNotGift,
+		ErrCouponNotDiscount: ErrorMessageCouponNotDiscount,
+	}
+)
+
+// Coupon describes a redeemable code.
+// Value is the discounted price for CouponTypeFixedDiscount, the discounted percentage for CouponTypePercentDiscount,
+// and the granted coins for CouponTypeCoinGrant.
+type Coupon struct {
+	Code      string     `gorm:"size:32;primary_key" json:"code"`
+	Batch     string     `gorm:"size:64;index;NOT NULL" json:"batch"`
+	Type      string     `gorm:"size:32;NOT NULL" json:"type"`
+	Value     uint64     `gorm:"NOT NULL" json:"value"`
+	MaxUses   uint       `gorm:"NOT NULL;default:1" json:"max_uses"`
+	UserLimit uint       `gorm:"NOT NULL;default:1" json:"user_limit"`
+	Used      uint       `gorm:"NOT NULL;default:0" json:"used"`
+	ExpireAt  *time.Time `json:"expire_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// CouponRedemption records each use of a coupon.
+// OrderID is the discounted order, or the grant reference in the game database for CouponTypeCoinGrant.
+type CouponRedemption struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	CouponCode string    `gorm:"size:32;index;NOT NULL" json:"coupon_code"`
+	Username   string    `gorm:"size:255;index;NOT NULL" json:"username"`
+	OrderID    string    `gorm:"size:32" json:"order_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type RedeemCouponRequest struct {
+	Code string `json:"code" validate:"required,min=4,max=32"`
+}
+
+type RedeemCouponResponse struct {
+	Code  string `json:"code"`
+	Coins uint64 `json:"coins"`
+}
+
+// Discount returns the price to be deducted from an order of price. At least 1 unit of price is left to be paid.
+func (c *Coupon) Discount(price uint64) uint64 {
+	var discount uint64
+	switch c.Type {
+	case CouponTypeFixedDiscount:
+		discount = c.Value
+	case CouponTypePercentDiscount:
+		discount = price * c.Value / 100
+	}
+	if discount >= price {
+		discount = price - 1
+	}
+	return discount
+}
+
+func normalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// generateCoupons creates count coupons in batch sharing the parameters of template
+func generateCoupons(batch string, count int, template Coupon) ([]Coupon, error) {
+	coupons := make([]Coupon, 0, count)
+	tx := WebData.Begin()
+	for i := 0; i < count; i++ {
+		coupon := template
+		coupon.Code = uniuri.NewLenChars(CouponCodeLength, CouponCodeCharCandidates)
+		coupon.Batch = batch
+		coupon.Used = 0
+		coupon.CreatedAt = time.Now()
+		if err := tx.Create(&coupon).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		coupons = append(coupons, coupon)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// redeemCoupon consumes one use of the coupon code by username within tx.
+// The coupon row is locked until tx finishes, so that concurrent redemptions of the same code are serialized.
+func redeemCoupon(tx *gorm.DB, code string, username string, orderId string) (*Coupon, error) {
+	var coupon Coupon
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("code = ?", normalizeCouponCode(code)).
+		First(&coupon).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, ErrCouponNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if coupon.ExpireAt != nil && coupon.ExpireAt.Before(time.Now()) {
+		return nil, ErrCouponExpired
+	}
+	if coupon.MaxUses != 0 && coupon.Used >= coupon.MaxUses {
+		return nil, ErrCouponExhausted
+	}
+
+	if coupon.UserLimit != 0 {
+		var redeemed uint
+		err = tx.Model(&CouponRedemption{}).
+			Where("coupon_code = ? AND username = ?", coupon.Code, username).
+			Count(&redeemed).Error
+		if err != nil {
+			return nil, err
+		}
+		if redeemed >= coupon.UserLimit {
+			return nil, ErrCouponUserLimit
+		}
+	}
+
+	err = tx.Model(&coupon).UpdateColumn("used", gorm.Expr("used + ?", 1)).Error
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Create(&CouponRedemption{
+		CouponCode: coupon.Code,
+		Username:   username,
+		OrderID:    orderId,
+		CreatedAt:  time.Now(),
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &coupon, nil
+}
+
+// releaseCoupon gives back the use of the coupon code consumed by orderId within tx, e.g. when the order is cancelled
+func releaseCoupon(tx *gorm.DB, code string, orderId string) error {
+	result := tx.Where("coupon_code = ? AND order_id = ?", code, orderId).Delete(&CouponRedemption{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return result.Error
+	}
+	return tx.Model(&Coupon{}).
+		Where("code = ? AND used > 0", code).
+		UpdateColumn("used", gorm.Expr("used - ?", 1)).Error
+}
+
+// revokeRedemption gives back the use of the gift coupon code consumed by the grant grantId, unless the grant has been
+// stored into the game database despite failing, e.g. when the connection broke after the insertion
+func revokeRedemption(code string, grantId string) error {
+	var granted int
+	if err := GameData.Model(&PaidOrder{}).Where("order_id = ?", grantId).Count(&granted).Error; err != nil {
+		return err
+	}
+	if granted != 0 {
+		return nil
+	}
+	tx := WebData.Begin()
+	if err := releaseCoupon(tx, code, grantId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func couponErrorResponse(err error) *echo.HTTPError {
+	if message, ok := couponErrorMessages[err]; ok {
+		return NewErrorResponse(http.StatusBadRequest, message)
+	}
+	LogDb.Errorf("redeem coupon error: %v", err)
+	return NewErrorResponse(http.StatusInternalServerError, ErrorMessageCouponRedeemFailed)
+}
+
+func redeemGiftCoupon(c echo.Context) error {
+	var form RedeemCouponRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	username := c.Get("token").(*Token).ParentUsername
+	grantId := uniuri.NewLenChars(32, OrderIDCharCandidates)
+
+	tx := WebData.Begin()
+	coupon, err := redeemCoupon(tx, form.Code, username, grantId)
+	if err == nil && coupon.Type != CouponTypeCoinGrant {
+		err = ErrCouponNotGift
+	}
+	if err != nil {
+		tx.Rollback()
+		return couponErrorResponse(err)
+	}
+
+	if err = tx.Commit().Error; err != nil {
+		requestLog(c, LogDb).Errorf("commit coupon redemption error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageCouponRedeemFailed)
+	}
+
+	// the coins are granted once the redemption is committed, so that they are never granted for a redemption rolled back
+	if err = grantCoins(grantId, username, coupon.Value); err != nil {
+		requestLog(c, LogPay).Errorf("grant coupon coins error: %v", err)
+		if err := revokeRedemption(coupon.Code, grantId); err != nil {
+			requestLog(c, LogDb).Errorf("revoke redemption %s of coupon %s error: %v", grantId, coupon.Code, err)
+		}
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageCouponRedeemFailed)
+	}
+
+	return c.JSON(http.StatusOK, RedeemCouponResponse{
+		Code:  coupon.Code,
+		Coins: coupon.Value,
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCouponDiscount(t *testing.T) {
+	tests := []struct {
+		name   string
+		coupon Coupon
+		price  uint64
+		want   uint64
+	}{
+		{"fixed", Coupon{Type: CouponTypeFixedDiscount, Value: 300}, 1000, 300},
+		{"fixed leaving 1", Coupon{Type: CouponTypeFixedDiscount, Value: 999}, 1000, 999},
+		{"fixed equal to the price", Coupon{Type: CouponTypeFixedDiscount, Value: 1000}, 1000, 999},
+		{"fixed above the price", Coupon{Type: CouponTypeFixedDiscount, Value: 5000}, 1000, 999},
+		{"fixed on the lowest price", Coupon{Type: CouponTypeFixedDiscount, Value: 300}, 1, 0},
+		{"percent", Coupon{Type: CouponTypePercentDiscount, Value: 20}, 1000, 200},
+		{"percent rounded down", Coupon{Type: CouponTypePercentDiscount, Value: 15}, 999, 149},
+		{"percent below 1", Coupon{Type: CouponTypePercentDiscount, Value: 10}, 9, 0},
+		{"whole percent", Coupon{Type: CouponTypePercentDiscount, Value: 100}, 1000, 999},
+		{"percent above 100", Coupon{Type: CouponTypePercentDiscount, Value: 150}, 1000, 999},
+		{"coin grant", Coupon{Type: CouponTypeCoinGrant, Value: 500}, 1000, 0},
+	}
+	for _, test := range tests {
+		if got := test.coupon.Discount(test.price); got != test.want {
+			t.Errorf("%s: Discount(%d) = %d, want %d", test.name, test.price, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeCouponCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"ABCD2345", "ABCD2345"},
+		{" abcd2345\n", "ABCD2345"},
+		{"AbCd", "ABCD"},
+	}
+	for _, test := range tests {
+		if got := normalizeCouponCode(test.code); got != test.want {
+			t.Errorf("normalizeCouponCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// settleOrder marks the order identified by orderId as paid on the platform with platformOrderId,
+// and delivers it to the game server. Shared by payment notifications and the reconciliation of missed notifications.
+// The order row is locked while being marked, so that concurrent settlements of the same order are serialized:
+// all but the first one get ErrOrderStateConflict along with the order settled before.
+// A failed delivery does not fail the settlement, the order stays paid and could be delivered again later.
+// Orders with a ReviewReason are held instead of being delivered.
+// A first purchase bonus is withdrawn if another order of the user has been paid meanwhile.
+func settleOrder(orderId string, platformOrderId string, paidAt time.Time, detail xorpay.PlatformNotifyResponseDetail) (*Order, error) {
+	tx := WebData.Begin()
+
+	var order Order
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("order_id = ?", orderId).
+		First(&order).Error
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	// orders paid on the cashier page learn their aoid from here
+	if order.PlatformOrderID != platformOrderId && !order.awaitsPlatformOrderID() {
+		tx.Rollback()
+		return &order, ErrPlatformOrderMismatch
+	}
+
+	fields := map[string]interface{}{
+		"platform_order_id": platformOrderId,
+		"paid_at":           &paidAt,
+		"transaction_id":    detail.TransactionID,
+		"transaction_type":  detail.TransactionType,
+	}
+
+	// the first purchase bonus is evaluated at placement, so it could have been promised to several unpaid orders.
+	// only the first one paid keeps it; the settlements of the same user are serialized to tell which one.
+	if order.BonusCoins != 0 && order.PromotionType == PromotionTypeFirstPurchase {
+		if err = lockUser(tx, order.ParentUsername); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		var paidOrders int
+		err = tx.Model(&Order{}).
+			Where("parent_username = ? AND paid_at IS NOT NULL AND order_id <> ?", order.ParentUsername, order.OrderID).
+			Count(&paidOrders).Error
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if paidOrders != 0 {
+			LogPay.Infof("first purchase bonus of order %s withdrawn, %s has paid another order before",
+				order.OrderID, order.ParentUsername)
+			fields["bonus_coins"] = 0
+		}
+	}
+
+	err = transitOrder(tx, &order, OrderStatusPaid, fields)
+	if err == nil && order.ReviewReason != "" {
+		err = transitOrder(tx, &order, OrderStatusHeld, nil)
+	}
+	if err != nil {
+		tx.Rollback()
+		return &order, err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	countOrder(OrderEventPaid, &order)
+	order.PlatformOrderID = platformOrderId
+	order.PaidAt = &paidAt
+	order.Paid = true
+	order.TransactionID = detail.TransactionID
+	order.TransactionType = detail.TransactionType
+	if _, ok := fields["bonus_coins"]; ok {
+		order.BonusCoins = 0
+	}
+
+	// credit the paid price together with the promotion bonus recorded at placement,
+	// unless the order is held for review
+	if order.Status == OrderStatusHeld {
+		LogPay.Infof("order %s held for review: %s", order.OrderID, order.ReviewReason)
+	} else if err = deliverOrder(&order); err != nil {
+		LogPay.Errorf("deliver order %s error: %v", order.OrderID, err)
+	}
+
+	RealtimeOrderBroker.Broadcast(&order, order.OrderID)
+	return &order, nil
+}
+
+// DeliveryAttempt records each attempt to deliver an order into the game database
+type DeliveryAttempt struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	OrderID     string    `gorm:"size:32;index;NOT NULL" json:"order_id"`
+	Succeeded   bool      `json:"succeeded"`
+	Error       string    `gorm:"type:text" json:"error"`
+	AttemptedAt time.Time `gorm:"NOT NULL" json:"attempted_at"`
+}
+
+func recordDeliveryAttempt(orderId string, err error) {
+	attempt := DeliveryAttempt{
+		OrderID:     orderId,
+		Succeeded:   err == nil,
+		AttemptedAt: time.Now(),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if err := WebData.Create(&attempt).Error; err != nil {
+		LogDb.Errorf("save delivery attempt error: %v", err)
+	}
+}
+
+// deliverOrder stores a paid order into the game database, where the game server credits the coins to the player.
+// Every call is recorded as a DeliveryAttempt.
+func deliverOrder(order *Order) (err error) {
+	defer func() {
+		recordDeliveryAttempt(order.OrderID, err)
+		if err == nil {
+			countOrder(OrderEventDelivered, order)
+		} else {
+			countOrder(OrderEventFailed, order)
+		}
+	}()
+
+	err = GameData.Create(&PaidOrder{
+		OrderID:   order.OrderID,
+		Username:  order.ParentUsername,
+		CreatedAt: order.CreatedAt,
+		PaidAt:    *order.PaidAt,
+		PaidPrice: order.PaidPrice,
+		Coins:     order.Coins(),
+		Processed: false,
+	}).Error
+	if err != nil {
+		// the order may have been stored by a previous delivery whose status update failed
+		var stored int
+		if GameData.Model(&PaidOrder{}).Where("order_id = ?", order.OrderID).Count(&stored); stored == 0 {
+			return err
+		}
+	}
+
+	now := time.Now()
+	err = transitOrder(WebData, order, OrderStatusDelivered, map[string]interface{}{
+		"processed_at": &now,
+	})
+	if err != nil {
+		return err
+	}
+	order.ProcessedAt = &now
+	order.Processed = true
+	return nil
+}
+
+// debitCoins takes back coins credited to the player of a delivered order.
+// If the game server has not processed the order yet, the coins are removed from the pending order;
+// otherwise they are debited from the player balance.
+// returns the coins which could not be debited because of an insufficient or inaccessible balance.
+func debitCoins(order *Order, coins uint64) (shortfall uint64, err error) {
+	result := GameData.Model(&PaidOrder{}).
+		Where("order_id = ? AND processed = ? AND coins >= ?", order.OrderID, false, coins).
+		UpdateColumn("coins", gorm.Expr("coins - ?", coins))
+	if result.Error != nil {
+		return coins, result.Error
+	}
+	if result.RowsAffected != 0 {
+		return 0, nil
+	}
+
+	if GameBalance.Table == "" {
+		return coins, nil
+	}
+
+	column := gorm.Expr(GameBalance.BalanceColumn)
+	result = GameData.Table(GameBalance.Table).
+		Where("? = ? AND ? >= ?", gorm.Expr(GameBalance.UsernameColumn), order.ParentUsername, column, coins).
+		UpdateColumn(GameBalance.BalanceColumn, gorm.Expr("? - ?", column, coins))
+	if result.Error != nil {
+		return coins, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return coins, nil
+	}
+	return 0, nil
+}
+
+// withdrawCoins takes back coins of an order refunded before being delivered, whose coins have never been credited.
+// A pending row stored by a delivery which failed to update the order status is removed, or reduced by coins if
+// partially refunded; the balance is debited only if the game server has processed such a row already.
+func withdrawCoins(order *Order, coins uint64) (shortfall uint64, err error) {
+	pending := GameData.Model(&PaidOrder{}).Where("order_id = ? AND processed = ?", order.OrderID, false)
+	var result *gorm.DB
+	if coins >= order.Coins() {
+		result = pending.Delete(&PaidOrder{})
+	} else {
+		result = pending.UpdateColumn("coins", gorm.Expr("coins - ?", coins))
+	}
+	if result.Error != nil {
+		return coins, result.Error
+	}
+	if result.RowsAffected != 0 {
+		return 0, nil
+	}
+
+	var processed int
+	if err = GameData.Model(&PaidOrder{}).Where("order_id = ?", order.OrderID).Count(&processed).Error; err != nil {
+		return coins, err
+	}
+	if processed == 0 {
+		return 0, nil
+	}
+	return debitCoins(order, coins)
+}
+
+// grantCoins credits coins to username without any payment, e.g. gift codes.
+// grantId identifies the grant in the game database and has to be unique.
+func grantCoins(grantId string, username string, coins uint64) error {
+	now := time.Now()
+	return GameData.Create(&PaidOrder{
+		OrderID:   grantId,
+		Username:  username,
+		CreatedAt: now,
+		PaidAt:    now,
+		PaidPrice: 0,
+		Coins:     coins,
+		Processed: false,
+	}).Error
+}
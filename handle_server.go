@@ -4,6 +4,7 @@ import (
 	"github.com/labstack/echo"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -14,6 +15,8 @@ type ServerStatusResponse struct {
 
 const (
 	StatusFetchTimeout = time.Second * 5
+	// ServerStatusUpdateInterval is how long the measured latency of the game server is reused
+	ServerStatusUpdateInterval = time.Minute * 5
 )
 
 var (
@@ -23,7 +26,11 @@ var (
 	}
 )
 
+// CachedServerStatus measures the game server at most once every UpdateInterval.
+// The measurement is guarded by mu, as it is read by the requests and the metrics scraper concurrently.
 type CachedServerStatus struct {
+	mu sync.Mutex
+
 	ServerAddress  string
 	LastLatency    int64
 	LastUpdate     time.Time
@@ -43,17 +50,18 @@ func getFreshStatus(serverAddress string) (latency int64) {
 	return end.Sub(start).Nanoseconds()
 }
 
+// NewStatusCache creates a status cache of the game server at serverAddress, which is measured once first asked
 func NewStatusCache(serverAddress string, updateInterval time.Duration) *CachedServerStatus {
-	currentLatency := getFreshStatus(serverAddress)
 	return &CachedServerStatus{
 		ServerAddress:  serverAddress,
-		LastLatency:    currentLatency,
-		LastUpdate:     time.Now(),
+		LastLatency:    -1,
 		UpdateInterval: updateInterval,
 	}
 }
 
 func (s *CachedServerStatus) Get() (online bool, latency int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.LastUpdate.Add(s.UpdateInterval).Before(time.Now()) {
 		s.LastLatency = getFreshStatus(s.ServerAddress)
 		s.LastUpdate = time.Now()
@@ -61,8 +69,15 @@ func (s *CachedServerStatus) Get() (online bool, latency int64) {
 	return s.LastLatency != -1, s.LastLatency
 }
 
+// Latency returns the latency last measured, -1 if unreachable or not measured yet, without measuring again
+func (s *CachedServerStatus) Latency() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.LastLatency
+}
+
 func provideServerStatus(c echo.Context) error {
-	online, latency := ServerStatusCache.Get()
+	online, latency := currentSettings().ServerStatus.Get()
 	if !online {
 		return c.JSON(http.StatusServiceUnavailable, ServerUnreachableResponse)
 	}
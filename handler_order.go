@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"github.com/GalvinGao/floatdream-backend/xorpay"
 	"github.com/biezhi/gorm-paginator/pagination"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/dchest/uniuri"
+	"github.com/jinzhu/gorm"
 	"github.com/labstack/echo"
+	"github.com/pkg/errors"
 	"net/http"
 	"strings"
 	"time"
@@ -19,6 +20,26 @@ const (
 	ErrorMessageSignInvalid            = "Sign 校验失败"
 
 	ErrorMessageNotifyDefaultError = "上下文校验失败：检查参数合法性"
+
+	ErrorMessagePayFailed              = "支付发起失败，稍后请重试"
+	ErrorMessagePayPlatformUnavailable = "支付平台暂时无法访问，稍后请重试"
+	ErrorMessagePayMisconfigured       = "支付配置错误，请联系管理员"
+	ErrorMessagePayDuplicated          = "订单已存在，请重新下单"
+	ErrorMessageOpenIDRequired         = "需要先完成微信授权"
+
+	PayModeQR       = "qr"
+	PayModeRedirect = "redirect"
+
+	// CashierExpiresIn is how long the cashier page is expected to be valid for, in seconds
+	CashierExpiresIn = 7200
+
+	NotificationResultReceived    = "received"
+	NotificationResultAccepted    = "accepted"
+	NotificationResultDuplicate   = "duplicate"
+	NotificationResultConflict    = "conflict"
+	NotificationResultRejected    = "rejected"
+	NotificationResultSignInvalid = "sign_invalid"
+	NotificationResultError       = "error"
 )
 
 var OrderIDCharCandidates = []byte("abcdefghijklmnopqrstuvwxyz0123456789")
@@ -41,13 +62,20 @@ type ListOrderRequest struct {
 
 type PlaceOrderRequest struct {
 	Price   uint64 `json:"price,string" validate:"required,min=1,max=10000"`
-	Payment string `json:"payment" validate:"required,oneof=alipay native"`
+	Payment string `json:"payment" validate:"required,oneof=alipay native jsapi"`
+	Mode    string `json:"mode" validate:"omitempty,oneof=qr redirect"`
+	Coupon  string `json:"coupon" validate:"omitempty,min=4,max=32"`
 }
 
+// PlaceOrderResponse carries one of QRContent, RedirectURL or JSAPIParams depending on the payment and mode requested
 type PlaceOrderResponse struct {
-	OrderID   string `json:"orderId"`
-	QRContent string `json:"qrContent"`
-	ExpiresIn uint   `json:"expiresIn"`
+	OrderID     string              `json:"orderId"`
+	QRContent   string              `json:"qrContent,omitempty"`
+	RedirectURL string              `json:"redirectUrl,omitempty"`
+	JSAPIParams *xorpay.JSAPIParams `json:"jsapiParams,omitempty"`
+	ExpiresIn   uint                `json:"expiresIn"`
+	Promotion   *AppliedPromotion   `json:"promotion,omitempty"`
+	Discount    uint64              `json:"discount,omitempty"`
 }
 
 func itemDetails(c echo.Context) error {
@@ -74,7 +102,7 @@ func itemDetails(c echo.Context) error {
 func listOrder(c echo.Context) error {
 	var query ListOrderRequest
 	if err := c.Bind(&query); err != nil {
-		LogDb.Printf("list query error: %v", err)
+		requestLog(c, LogDb).Errorf("list query error: %v", err)
 		return DefaultBadRequestResponse
 	}
 
@@ -83,7 +111,7 @@ func listOrder(c echo.Context) error {
 		ParentUsername: c.Get("token").(*Token).ParentUsername,
 	})
 	if db.Error != nil {
-		LogDb.Printf("find orders error: %v", db.Error)
+		requestLog(c, LogDb).Errorf("find orders error: %v", db.Error)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessageDatabaseError)
 	}
 
@@ -92,7 +120,6 @@ func listOrder(c echo.Context) error {
 		Page:    query.Page,
 		Limit:   query.Limit,
 		OrderBy: []string{strings.Join([]string{query.SortKey, query.SortOrder}, " ")},
-		ShowSQL: true,
 	}, &orders)
 	return c.JSON(http.StatusOK, paginator)
 }
@@ -104,7 +131,7 @@ func queryOrderStatus(c echo.Context) error {
 		ParentUsername: c.Get("token").(*Token).ParentUsername,
 	}).Last(&order).Error
 	if err != nil {
-		LogDb.Printf("query order error: %v", err)
+		requestLog(c, LogDb).Errorf("query order error: %v", err)
 		return NewErrorResponse(http.StatusBadRequest, "未找到订单")
 	}
 
@@ -130,7 +157,9 @@ func pollOrderStatus(c echo.Context) error {
 		return err
 	}
 
+	sseSubscribers.Inc()
 	defer func() {
+		sseSubscribers.Dec()
 		RealtimeOrderBroker.Unsubscribe(subscriber, orderId)
 		keepAliveTimer.Stop()
 		expireTimer.Stop()
@@ -153,9 +182,15 @@ BROKER:
 			break BROKER
 		case <-c.Request().Context().Done():
 			break BROKER
+		case <-ServerLifecycle.Done():
+			// the server is going down, the client should reconnect to another instance or after the restart
+			if _, err := c.Response().Write([]byte("event: reconnect\nretry: 3000\ndata: reconnect\n\n")); err != nil {
+				return c.NoContent(http.StatusInternalServerError)
+			}
+			c.Response().Flush()
+			break BROKER
 		case data := <-subscriber.GetMessages():
 			order := data.GetPayload().(*Order)
-			spew.Dump(order)
 			if order.OrderID == orderId && order.ParentUsername == c.Get("token").(*Token).ParentUsername {
 				if _, err := c.Response().Write([]byte(fmt.Sprintf("event: received\ndata: %s\n\n", order.OrderID))); err != nil {
 					return c.NoContent(http.StatusInternalServerError)
@@ -171,133 +206,344 @@ BROKER:
 func placeOrder(c echo.Context) error {
 	var form PlaceOrderRequest
 	if err := c.Bind(&form); err != nil {
-		LogPay.Printf("bind form error: %v", err)
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
 		return DefaultBadRequestResponse
 	}
 	if err := c.Validate(&form); err != nil {
-		LogPay.Printf("validate form error: %v", err)
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
 		return DefaultBadRequestResponse
 	}
 
+	token := c.Get("token").(*Token)
+	username := token.ParentUsername
+
+	// paying inside WeChat requires the openid of the buyer, acquired by requestWeChatOpenID beforehand
+	if form.Payment == xorpay.PayTypeJSAPI && token.WeChatOpenID == "" {
+		return NewErrorResponse(http.StatusPreconditionRequired, ErrorMessageOpenIDRequired)
+	}
+
+	// the placements of the same user are serialized until the order is created, so that concurrent ones could not
+	// all pass the limits checked below. the coupon is reserved along with the order, before the payment is initiated
+	// outside of the transaction, so that neither the user nor the coupon stays locked while waiting on the platform.
+	tx := WebData.Begin()
+	if err := lockUser(tx, username); err != nil {
+		tx.Rollback()
+		requestLog(c, LogDb).Errorf("lock user %s error: %v", username, err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
 	// generate a 32 bytes-long containing only OrderIDCharCandidates characters random string as the new orderId
 	orderId := uniuri.NewLenChars(32, OrderIDCharCandidates)
 
-	// sends the payment request
-	response, err := PaySession.Pay(xorpay.Transaction{
-		Name:    "Life 币充值",
-		PayType: form.Payment,
-		Price:   form.Price,
-		OrderID: orderId,
+	var discount uint64
+	if form.Coupon != "" {
+		coupon, err := redeemCoupon(tx, form.Coupon, username, orderId)
+		if err == nil && coupon.Type == CouponTypeCoinGrant {
+			err = ErrCouponNotDiscount
+		}
+		if err != nil {
+			tx.Rollback()
+			return couponErrorResponse(err)
+		}
+		discount = coupon.Discount(form.Price)
+	}
+
+	// check the limits and the other rules with the price to be charged, as the orders are counted once stored.
+	// the coupon is given back with the transaction rolled back if rejected.
+	settings := currentSettings()
+	decision, err := evaluateOrderRules(settings.OrderRules, &OrderAttempt{
+		Username: username,
+		ClientIP: c.RealIP(),
+		Price:    form.Price - discount,
+		PayType:  form.Payment,
+		At:       time.Now().In(Timezone),
 	})
 	if err != nil {
-		LogPay.Printf("create order error: %v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "支付发起失败，稍后请重试")
+		tx.Rollback()
+		requestLog(c, LogDb).Errorf("evaluate order rules error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	if decision.Action == RiskActionReject {
+		tx.Rollback()
+		requestLog(c, LogPay).Warnf("order of %s rejected by rule %s: %s", username, decision.Rule, decision.Reason)
+		return NewErrorResponse(http.StatusForbidden, decision.Reason)
 	}
 
-	err = WebData.Create(&Order{
+	// evaluate the promotions before the payment so that the bonus is determined at placement
+	promotion, err := evaluatePromotions(settings.Promotions, username, form.Price, time.Now())
+	if err != nil {
+		tx.Rollback()
+		requestLog(c, LogDb).Errorf("evaluate promotions error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	// the aoid stays unknown until the platform creates the order, the order id takes its place until then.
+	// for the cashier page, which is opened by the buyer directly, it is only known once the payment is notified.
+	order := Order{
 		OrderID:         orderId,
-		PlatformOrderID: response.PlatformOrderID,
-		ParentUsername:  c.Get("token").(*Token).ParentUsername,
+		PlatformOrderID: orderId,
+		ParentUsername:  username,
 		PayType:         form.Payment,
+		Status:          OrderStatusCreated,
 		CreatedAt:       time.Now(),
-		PaidPrice:       form.Price,
-	}).Error
+		PaidPrice:       form.Price - discount,
+		CouponCode:      normalizeCouponCode(form.Coupon),
+		DiscountPrice:   discount,
+		ClientIP:        c.RealIP(),
+	}
+	if decision.Action == RiskActionHold {
+		order.ReviewReason = decision.Reason
+	}
+	if promotion != nil {
+		order.PromotionID = promotion.ID
+		order.PromotionType = promotion.Type
+		order.BonusCoins = promotion.Bonus
+	}
+
+	err = tx.Create(&order).Error
+	if err == nil {
+		err = tx.Commit().Error
+	} else {
+		tx.Rollback()
+	}
 	if err != nil {
-		LogDb.Printf("save order error: %v", err)
+		requestLog(c, LogDb).Errorf("save order error: %v", err)
 		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
 	}
 
-	return c.JSON(http.StatusCreated, PlaceOrderResponse{
+	transaction := xorpay.Transaction{
+		Name:    "Life 币充值",
+		PayType: form.Payment,
+		Price:   order.PaidPrice,
+		OrderID: orderId,
+	}
+	result := PlaceOrderResponse{
 		OrderID:   orderId,
-		QRContent: response.Info.QR,
-		ExpiresIn: response.ExpiresIn,
-	})
+		Promotion: promotion,
+		Discount:  discount,
+	}
+
+	if form.Payment == xorpay.PayTypeNative && form.Mode == PayModeRedirect {
+		returnUrl := fmt.Sprintf("%s/api/topup/order/%s/return", settings.PublicURL, orderId)
+		result.RedirectURL = PaySession.CashierURL(transaction, returnUrl)
+		result.ExpiresIn = CashierExpiresIn
+	} else {
+		transaction.OpenID = token.WeChatOpenID
+
+		// sends the payment request
+		response, err := PaySession.Pay(c.Request().Context(), transaction)
+		if err != nil {
+			requestLog(c, LogPay).Errorf("create order error: %v", err)
+			if errors.Cause(err) == xorpay.ErrPlatformUnavailable {
+				closeUnansweredOrder(c, orderId)
+			}
+			if err := abandonOrder(&order); err != nil {
+				requestLog(c, LogDb).Errorf("cancel order %s error: %v", orderId, err)
+			}
+			return payErrorResponse(err)
+		}
+
+		result.ExpiresIn = response.ExpiresIn
+		switch {
+		case form.Payment == xorpay.PayTypeJSAPI:
+			result.JSAPIParams = &response.Info.JSAPIParams
+		case form.Mode == PayModeRedirect:
+			// the qr content of alipay is an url opening the alipay app on mobile phones
+			result.RedirectURL = response.Info.QR
+		default:
+			result.QRContent = response.Info.QR
+		}
+
+		// unless a notification has told the aoid already
+		err = WebData.Model(&Order{}).
+			Where("order_id = ? AND platform_order_id = ?", orderId, orderId).
+			Updates(map[string]interface{}{
+				"platform_order_id": response.PlatformOrderID,
+				"qr_content":        result.QRContent,
+			}).Error
+		if err != nil {
+			requestLog(c, LogDb).Errorf("save order %s aoid %s error: %v", orderId, response.PlatformOrderID, err)
+			return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+		}
+		order.PlatformOrderID = response.PlatformOrderID
+		order.QRContent = result.QRContent
+	}
+
+	countOrder(OrderEventCreated, &order)
+	audit(c, AuditActionPlaceOrder, "order:"+order.OrderID, order.ReviewReason, nil, newAdminOrder(order))
+
+	return c.JSON(http.StatusCreated, result)
+}
+
+// closeUnansweredOrder closes the order orderId on the platform in case it has been created although the pay request
+// failed, so that it could not be paid once cancelled here. The pay request is not retried, as the qr code of an
+// order could not be retrieved but by creating it.
+func closeUnansweredOrder(c echo.Context, orderId string) {
+	upstream, err := PaySession.QueryOrder(c.Request().Context(), orderId)
+	if err != nil {
+		requestLog(c, LogPay).Errorf("query platform order of %s error: %v", orderId, err)
+		return
+	}
+	if upstream.Status == xorpay.QueryStatusNotExist || upstream.PlatformOrderID == "" {
+		return
+	}
+	if err = PaySession.Close(c.Request().Context(), upstream.PlatformOrderID); err != nil {
+		requestLog(c, LogPay).Errorf("close platform order %s of %s error: %v", upstream.PlatformOrderID, orderId, err)
+	}
+}
+
+// abandonOrder cancels an unpaid order and gives back the coupon it used
+func abandonOrder(order *Order) error {
+	tx := WebData.Begin()
+	err := transitOrder(tx, order, OrderStatusCancelled, nil)
+	if err == nil && order.CouponCode != "" {
+		err = releaseCoupon(tx, order.CouponCode, order.OrderID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// landOrderReturn is where the buyer is sent back to after paying on the cashier page.
+// It resumes the order status page of the frontend.
+func landOrderReturn(c echo.Context) error {
+	orderId := c.Param("orderId")
+	for _, r := range orderId {
+		if !strings.ContainsRune(string(OrderIDCharCandidates), r) {
+			return DefaultBadRequestResponse
+		}
+	}
+	return c.Redirect(http.StatusFound, fmt.Sprintf(currentSettings().OrderPageURL, orderId))
+}
+
+// resolve records the handling result of the notification
+func (n *PaymentNotification) resolve(result string) {
+	n.Result = result
+	if n.ID == 0 {
+		return
+	}
+	if err := WebData.Model(n).Update("result", result).Error; err != nil {
+		LogDb.Errorf("update notification %d result error: %v", n.ID, err)
+	}
+}
+
+// payErrorResponse tells the user what went wrong when initiating a payment
+func payErrorResponse(err error) *echo.HTTPError {
+	switch errors.Cause(err) {
+	case xorpay.ErrPlatformUnavailable:
+		return NewErrorResponse(http.StatusServiceUnavailable, ErrorMessagePayPlatformUnavailable)
+	case xorpay.ErrSignRejected, xorpay.ErrMissingArgument:
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessagePayMisconfigured)
+	case xorpay.ErrOrderExists:
+		return NewErrorResponse(http.StatusConflict, ErrorMessagePayDuplicated)
+	default:
+		return NewErrorResponse(http.StatusBadGateway, ErrorMessagePayFailed)
+	}
 }
 
 func storeOrder(c echo.Context) error {
 	var form xorpay.PlatformNotifyResponse
 	if err := c.Bind(&form); err != nil {
-		LogPay.Printf("bind form error: %v", err)
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
 		return DefaultBadRequestResponse
 	}
+
+	// keep the notification before anything else, so that it could be examined even if it fails to be handled
+	notification := PaymentNotification{
+		PlatformOrderID: form.PlatformOrderID,
+		OrderID:         form.OrderID,
+		PayPrice:        form.PayPrice,
+		PayTime:         form.PayTime,
+		Sign:            form.Sign,
+		Detail:          form.Detail,
+		RemoteIP:        c.RealIP(),
+		Result:          NotificationResultReceived,
+		ReceivedAt:      time.Now(),
+	}
+	if err := WebData.Create(&notification).Error; err != nil {
+		requestLog(c, LogDb).Errorf("store notification error: %v", err)
+	}
+
 	if err := c.Validate(&form); err != nil {
-		LogPay.Printf("validate form error: %v", err)
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
+		notification.resolve(NotificationResultRejected)
 		return DefaultBadRequestResponse
 	}
 
 	if !PaySession.CheckSign(&form) {
-		LogPay.Printf("check sign error for form: %v", spew.Sdump(form))
+		requestLog(c, LogPay).Warnf("check sign error for notification of order %s (aoid %s)", form.OrderID, form.PlatformOrderID)
+		notification.resolve(NotificationResultSignInvalid)
 		return NewErrorResponse(http.StatusNotAcceptable, ErrorMessageSignInvalid)
 	}
 
-	timezone, err := time.LoadLocation("Asia/Shanghai")
-	if err != nil {
-		LogPay.Printf("read timezone error: %v", err)
-		return c.String(http.StatusInternalServerError, "服务器内部错误")
-	}
+	// only the notifications signed by the platform are audited, as anyone could post to the callback.
+	// the rejected ones are kept as payment notifications all the same.
+	defer func() {
+		auditAs(c, AuditActorPaymentPlatform, AuditActionNotify, "order:"+notification.OrderID,
+			notification.Result, nil, notification)
+	}()
 
-	paidAt, err := time.ParseInLocation("2006-01-02 15:04:05", form.PayTime, timezone)
+	paidAt, err := time.ParseInLocation("2006-01-02 15:04:05", form.PayTime, xorpay.Location)
 	if err != nil {
-		LogPay.Printf("parse time error: %v", err)
+		requestLog(c, LogPay).Errorf("parse time error: %v", err)
+		notification.resolve(NotificationResultRejected)
 		return DefaultBadRequestResponse
 	}
 
 	var detail xorpay.PlatformNotifyResponseDetail
 	if err = json.Unmarshal([]byte(form.Detail), &detail); err != nil {
-		LogPay.Printf("unmarshal error: %v", err)
+		requestLog(c, LogPay).Errorf("unmarshal error: %v", err)
+		notification.resolve(NotificationResultRejected)
 		return DefaultBadRequestResponse
 	}
 
-	// search for the corresponding order
-	db := WebData.Where(&Order{
-		PlatformOrderID: form.PlatformOrderID,
-		ParentUsername:  c.Get("token").(*Token).ParentUsername,
-	})
-
-	if err = db.Error; err != nil {
-		LogPay.Printf("find initial order error: %v", err)
+	// according to form posted, update and deliver the corresponding order
+	order, err := settleOrder(form.OrderID, form.PlatformOrderID, paidAt, detail)
+	switch {
+	case err == nil:
+		notification.resolve(NotificationResultAccepted)
+	case gorm.IsRecordNotFoundError(err):
+		requestLog(c, LogPay).Errorf("find initial order error: %v", err)
+		notification.resolve(NotificationResultRejected)
 		return NewErrorResponse(http.StatusFailedDependency, "无对应用户订单记录")
-	}
-
-	var order Order
-	if err = db.Find(&order).Error; err != nil {
-		LogPay.Printf("find initial order error: %v", err)
+	case err == ErrOrderStateConflict && order.settledBy(detail.TransactionID):
+		// the platform retried a notification which has been handled already
+		requestLog(c, LogPay).Infof("duplicated notification for order %s in status %s", order.OrderID, order.Status)
+		notification.resolve(NotificationResultDuplicate)
+	case err == ErrOrderStateConflict || err == ErrPlatformOrderMismatch:
+		// e.g. a payment of a cancelled order, or of an order marked paid by hand with another transaction.
+		// the money has been received anyway, so it is left to the admins through searchNotifications.
+		requestLog(c, LogPay).Errorf("conflicting notification of order %s (aoid %s, transaction %s) "+
+			"with already existing order in status %s (aoid %s, transaction %s)",
+			form.OrderID, form.PlatformOrderID, detail.TransactionID, order.Status, order.PlatformOrderID, order.TransactionID)
+		notification.resolve(NotificationResultConflict)
+		return NewErrorResponse(http.StatusConflict, "重复的订单记录")
+	default:
+		requestLog(c, LogPay).Errorf("settle order error: %v", err)
+		notification.resolve(NotificationResultError)
 		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
 	}
 
-	// the order has already been saved before. abort to prevent saving duplicated order information.
-	if order.PaidAt != nil {
-		LogPay.Printf("attempt to save duplicated order %v with already existing order %v",
-			spew.Sdump(form), spew.Sdump(order))
-		return NewErrorResponse(http.StatusConflict, "重复的订单记录")
-	}
+	return c.NoContent(http.StatusAccepted)
+}
 
-	// according to form posted, update the corresponding order
-	err = db.Update(&Order{
-		PaidAt:          &paidAt,
-		TransactionID:   detail.TransactionID,
-		TransactionType: detail.TransactionType,
-		//TransactionBuyer: detail.TransactionBuyer,
-	}).Error
+// payOrderInSandbox pays the order on the sandbox payment platform, which then notifies the payment as usual
+func payOrderInSandbox(c echo.Context) error {
+	var order Order
+	err := WebData.Where(&Order{
+		OrderID:        c.Param("orderId"),
+		ParentUsername: c.Get("token").(*Token).ParentUsername,
+	}).First(&order).Error
 	if err != nil {
-		LogPay.Printf("update order error: %v", err)
-		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+		requestLog(c, LogDb).Errorf("query order error: %v", err)
+		return NewErrorResponse(http.StatusBadRequest, "未找到订单")
 	}
 
-	//err = GameData.Create(&PaidOrder{
-	//	OrderID:   order.OrderID,
-	//	Username:  c.Get("token").(*Token).ParentUsername,
-	//	CreatedAt: order.CreatedAt,
-	//	PaidAt:    paidAt,
-	//	PaidPrice: order.PaidPrice,
-	//	Processed: false,
-	//}).Error
-	//if err != nil {
-	//	LogPay.Printf("store order to game db error: %v", err)
-	//	return DefaultBadRequestResponse
-	//}
-
-	RealtimeOrderBroker.Broadcast(&order, order.OrderID)
-
+	if err = PaySandbox.Pay(order.OrderID); err != nil {
+		requestLog(c, LogPay).Errorf("sandbox pay order %s error: %v", order.OrderID, err)
+		return NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
 	return c.NoContent(http.StatusAccepted)
 }
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/davecgh/go-spew/spew"
 	"github.com/dchest/uniuri"
 	"github.com/labstack/echo"
 	"net/http"
@@ -33,36 +32,51 @@ type UserInfoResponse struct {
 	BalanceLastTopup *time.Time `json:"balance_last_topup,emitempty"`
 }
 
+// verifyReCAPTCHA checks the reCAPTCHA response solved by the client of the login request
+func verifyReCAPTCHA(c echo.Context, response string) error {
+	resp, err := ReCAPTCHAValidator.VerifyWithIP(response, c.RealIP())
+	switch {
+	case err != nil:
+		captchaVerifications.WithLabelValues(CaptchaOutcomeError).Inc()
+	case resp.Success != true:
+		captchaVerifications.WithLabelValues(CaptchaOutcomeFailure).Inc()
+	default:
+		captchaVerifications.WithLabelValues(CaptchaOutcomeSuccess).Inc()
+	}
+	if err != nil || resp.Success != true {
+		requestLog(c, LogAuth).Warnf("recaptcha error: %v", err)
+		return NewErrorResponse(http.StatusBadRequest, "reCAPTCHA 人机识别验证失败：请刷新页面重试")
+	}
+	return nil
+}
+
 func validateUser(c echo.Context) error {
 	var form UserLoginRequest
 	if err := c.Bind(&form); err != nil {
-		LogAuth.Printf("bind form error: %v", err)
+		requestLog(c, LogAuth).Warnf("bind form error: %v", err)
 		return DefaultBadRequestResponse
 	}
 	if err := c.Validate(&form); err != nil {
-		LogAuth.Printf("validate form error: %v", err)
+		requestLog(c, LogAuth).Warnf("validate form error: %v", err)
 		return DefaultBadRequestResponse
 	}
 
-	resp, err := ReCAPTCHAValidator.VerifyWithIP(form.ReCAPTCHA, c.RealIP())
-	if err != nil || resp.Success != true {
-		LogAuth.Printf("recaptcha error: %v", err)
-		return NewErrorResponse(http.StatusBadRequest, "reCAPTCHA 人机识别验证失败：请刷新页面重试")
+	if err := verifyReCAPTCHA(c, form.ReCAPTCHA); err != nil {
+		return err
 	}
 
-	spew.Dump(form)
-
 	var attemptValidateUser AuthMeUser
-	err = AuthMeData.Where(&AuthMeUser{
+	err := AuthMeData.Where(&AuthMeUser{
 		Username: form.Username,
 	}).First(&attemptValidateUser).Error
 	if err != nil {
-		LogDb.Printf("find user error: %v", err)
+		requestLog(c, LogDb).Errorf("find user error: %v", err)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessageNoSuchUser)
 	}
 
 	ok := checkUserCredentials(attemptValidateUser.Password, form.Password)
 	if !ok {
+		auditAs(c, form.Username, AuditActionLoginFailed, "user:"+form.Username, "", nil, nil)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessagePasswordError)
 	}
 
@@ -76,9 +90,10 @@ func validateUser(c echo.Context) error {
 		ExpireAt: time.Now().Add(TokenLifetime),
 	}).FirstOrCreate(&token).Error
 	if err != nil {
-		LogDb.Printf("create token error: %v", err)
+		requestLog(c, LogDb).Errorf("create token error: %v", err)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessageTokenError)
 	}
+	auditAs(c, attemptValidateUser.Username, AuditActionLogin, "user:"+attemptValidateUser.Username, "", nil, nil)
 
 	return c.JSON(http.StatusAccepted, UserLoginResponse{
 		Username: attemptValidateUser.Username,
@@ -88,10 +103,12 @@ func validateUser(c echo.Context) error {
 }
 
 func invalidateUser(c echo.Context) error {
-	if err := WebData.Delete(c.Get("token").(*Token)).Error; err != nil {
-		LogDb.Printf("delete token error: %v", err)
+	token := c.Get("token").(*Token)
+	if err := WebData.Delete(token).Error; err != nil {
+		requestLog(c, LogDb).Errorf("delete token error: %v", err)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessageTokenError)
 	}
+	audit(c, AuditActionLogout, "user:"+token.ParentUsername, "", nil, nil)
 	return c.NoContent(http.StatusOK)
 }
 
@@ -102,7 +119,7 @@ func retrieveUserInfo(c echo.Context) error {
 		Username: username,
 	}).Last(&user).Error
 	if err != nil {
-		LogDb.Printf("find user error: %v", err)
+		requestLog(c, LogDb).Errorf("find user error: %v", err)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessageDatabaseError)
 	}
 
@@ -111,7 +128,7 @@ func retrieveUserInfo(c echo.Context) error {
 		ParentUsername: username,
 	}).Last(&latestOrder).Error
 	if err != nil {
-		LogDb.Printf("get latest order error: %v", err)
+		requestLog(c, LogDb).Errorf("get latest order error: %v", err)
 		return NewErrorResponse(http.StatusBadRequest, ErrorMessageDatabaseError)
 	}
 
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"github.com/dchest/uniuri"
+	"github.com/labstack/echo"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ErrorMessageOpenIDStateInvalid = "微信授权已失效，请重试"
+)
+
+type WeChatOpenIDRequest struct {
+	Return string `query:"return" validate:"required,max=255"`
+}
+
+type WeChatOpenIDCallbackRequest struct {
+	State  string `query:"state" validate:"required,len=32"`
+	OpenID string `query:"openid" validate:"required,max=64"`
+	Return string `query:"return" validate:"required,max=255"`
+}
+
+// isLocalPath prevents redirecting to other sites, by only allowing paths on this server
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "/\\")
+}
+
+// requestWeChatOpenID redirects the buyer to acquire the WeChat openid, used by jsapi payments.
+// It is opened as a page inside WeChat, hence the token is passed as the `bearer` query parameter.
+func requestWeChatOpenID(c echo.Context) error {
+	var query WeChatOpenIDRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogAuth).Warnf("bind query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil || !isLocalPath(query.Return) {
+		requestLog(c, LogAuth).Warnf("validate query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	token := c.Get("token").(*Token)
+	state := uniuri.NewLen(32)
+	err := WebData.Model(&Token{}).Where("token = ?", token.Token).Update("openid_state", state).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("save openid state error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+
+	v := url.Values{}
+	v.Set("state", state)
+	v.Set("return", query.Return)
+	callback := fmt.Sprintf("%s/api/topup/wechat/openid/callback?%s", currentSettings().PublicURL, v.Encode())
+	return c.Redirect(http.StatusFound, PaySession.OpenIDURL(callback))
+}
+
+// receiveWeChatOpenID stores the openid acquired into the token which requested it,
+// and sends the buyer back to where the acquisition started
+func receiveWeChatOpenID(c echo.Context) error {
+	var query WeChatOpenIDCallbackRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogAuth).Warnf("bind query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil || !isLocalPath(query.Return) {
+		requestLog(c, LogAuth).Warnf("validate query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	result := WebData.Model(&Token{}).Where("openid_state = ?", query.State).Updates(map[string]interface{}{
+		"wechat_openid": query.OpenID,
+		"openid_state":  "",
+	})
+	if result.Error != nil {
+		requestLog(c, LogDb).Errorf("save openid error: %v", result.Error)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	if result.RowsAffected == 0 {
+		requestLog(c, LogAuth).Warnf("openid state %s not found", query.State)
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageOpenIDStateInvalid)
+	}
+
+	return c.Redirect(http.StatusFound, currentSettings().PublicURL+query.Return)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+
+	HealthCheckTimeout = time.Second * 3
+)
+
+var (
+	startedAt = time.Now()
+)
+
+// HealthCheck checks a dependency, returning nil if it is usable
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type HealthCheckResult struct {
+	Status string `json:"status"`
+	// Duration is in milliseconds
+	Duration float64 `json:"duration"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                       `json:"status"`
+	Uptime string                       `json:"uptime"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+func pingDatabase(db *gorm.DB) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return db.DB().PingContext(ctx)
+	}
+}
+
+// checkMigrations tells if the WebMigrations have all been applied and the tables of GameModels all exist
+func checkMigrations(ctx context.Context) error {
+	pending, err := pendingMigrations(WebData, WebMigrations)
+	if err != nil {
+		return err
+	}
+	if pending != 0 {
+		return fmt.Errorf("%d migrations pending", pending)
+	}
+	for _, model := range GameModels {
+		if !GameData.HasTable(model) {
+			return fmt.Errorf("table of %T is missing", model)
+		}
+	}
+	return nil
+}
+
+// pingPaymentPlatform tells if the payment platform answers at all; any response below 500 will do
+func pingPaymentPlatform(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, PaySession.BaseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// NewReadinessChecks lists the dependencies the server needs to serve requests
+func NewReadinessChecks(checkPayment bool) []HealthCheck {
+	checks := []HealthCheck{
+		{Name: "web", Check: pingDatabase(WebData)},
+		{Name: "authme", Check: pingDatabase(AuthMeData)},
+		{Name: "game", Check: pingDatabase(GameData)},
+		{Name: "migrations", Check: checkMigrations},
+	}
+	if checkPayment {
+		checks = append(checks, HealthCheck{Name: "payment", Check: pingPaymentPlatform})
+	}
+	return checks
+}
+
+// runHealthChecks runs checks concurrently, each within HealthCheckTimeout
+func runHealthChecks(ctx context.Context, checks []HealthCheck) (bool, map[string]HealthCheckResult) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	healthy := true
+	results := make(map[string]HealthCheckResult, len(checks))
+
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check HealthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Check(ctx)
+			result := HealthCheckResult{
+				Status:   HealthStatusOK,
+				Duration: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				result.Status = HealthStatusFail
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[check.Name] = result
+			if err != nil {
+				healthy = false
+			}
+			mu.Unlock()
+		}(check)
+	}
+	wg.Wait()
+	return healthy, results
+}
+
+// checkLiveness tells the process is up and serving, without looking at any dependency
+func checkLiveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthResponse{
+		Status: HealthStatusOK,
+		Uptime: time.Since(startedAt).String(),
+	})
+}
+
+// checkReadiness tells if every dependency in checks is usable, answering 503 otherwise
+func checkReadiness(checks []HealthCheck) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// stop receiving traffic while draining
+		if ServerLifecycle.ShuttingDown() {
+			return c.JSON(http.StatusServiceUnavailable, HealthResponse{
+				Status: HealthStatusFail,
+				Uptime: time.Since(startedAt).String(),
+			})
+		}
+
+		healthy, results := runHealthChecks(c.Request().Context(), checks)
+		response := HealthResponse{
+			Status: HealthStatusOK,
+			Uptime: time.Since(startedAt).String(),
+			Checks: results,
+		}
+		if !healthy {
+			response.Status = HealthStatusFail
+			for name, result := range results {
+				if result.Status == HealthStatusFail {
+					requestLog(c, LogDb).Warnf("readiness check %s failed: %s", name, result.Error)
+				}
+			}
+			return c.JSON(http.StatusServiceUnavailable, response)
+		}
+		return c.JSON(http.StatusOK, response)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultShutdownTimeout = time.Second * 30
+)
+
+// Lifecycle runs the background jobs and tells the long-lived handlers when the server is shutting down
+type Lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	jobs   sync.WaitGroup
+}
+
+func NewLifecycle() *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Lifecycle{
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Done is closed once the shutdown begins
+func (l *Lifecycle) Done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+func (l *Lifecycle) ShuttingDown() bool {
+	return l.ctx.Err() != nil
+}
+
+// Go runs job in the background until it returns; ctx is cancelled when the shutdown begins
+func (l *Lifecycle) Go(job func(ctx context.Context)) {
+	l.jobs.Add(1)
+	go func() {
+		defer l.jobs.Done()
+		job(l.ctx)
+	}()
+}
+
+// Shutdown ends the streams and the background jobs, stops accepting connections and waits for the requests
+// in flight, giving up after timeout
+func (l *Lifecycle) Shutdown(e *echo.Echo, timeout time.Duration) error {
+	l.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := e.Shutdown(ctx)
+
+	jobsDone := make(chan struct{})
+	go func() {
+		l.jobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		LogHTTP.Warnf("background jobs still running after %s", timeout)
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
+}
+
+// waitForSignal blocks until the process is asked to terminate
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return <-signals
+}
+
+// closeDatabases closes the connections opened by main
+func closeDatabases() {
+	for name, db := range map[string]*gorm.DB{
+		"web":    WebData,
+		"authme": AuthMeData,
+		"game":   GameData,
+	} {
+		if db == nil {
+			continue
+		}
+		if err := db.Close(); err != nil {
+			LogDb.Errorf("close database `%s` error: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/dchest/uniuri"
+	"github.com/labstack/echo"
+	"github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	// HeaderRequestID carries the id of a request, taken from the client or the proxy if present
+	HeaderRequestID = "X-Request-ID"
+	RedactedValue   = "[REDACTED]"
+)
+
+var (
+	// sensitiveKeys are the field names whose values never reach the logs
+	sensitiveKeys = []string{"password", "passwd", "secret", "token", "sign", "authorization", "cookie", "dsn"}
+
+	// sensitivePatterns find the sensitive values formatted into the messages, such as key=value,
+	// "key":"value" and Key:value as printed by %+v
+	sensitivePatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)("?[a-z_]*(?:password|passwd|secret|token|sign|bearer)"?\s*[:=]\s*"?)([^"\s,&}]+)`),
+		regexp.MustCompile(`(?i)(bearer\s+)(\S+)`),
+	}
+)
+
+type LogConfig struct {
+	// Level is one of debug, info, warn and error; info by default
+	Level string `yaml:"level" validate:"omitempty,oneof=debug info warn warning error"`
+	// Format is either text or json; text by default
+	Format string `yaml:"format" validate:"omitempty,oneof=text json"`
+}
+
+// redactingFormatter removes the passwords, tokens and secrets from the entries before formatting them
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactText(text string) string {
+	for _, pattern := range sensitivePatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+RedactedValue)
+	}
+	return text
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		switch value := v.(type) {
+		case string:
+			if isSensitiveKey(k) {
+				v = RedactedValue
+			} else {
+				v = redactText(value)
+			}
+		case error:
+			v = redactText(value.Error())
+		default:
+			if isSensitiveKey(k) {
+				v = RedactedValue
+			}
+		}
+		redacted.Data[k] = v
+	}
+	redacted.Message = redactText(entry.Message)
+	return f.Formatter.Format(&redacted)
+}
+
+// newLogger creates the logger shared by all the components, writing text at info level until configured
+func newLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.Out = os.Stdout
+	logger.Formatter = &redactingFormatter{&logrus.TextFormatter{FullTimestamp: true}}
+	return logger
+}
+
+// configureLogger applies the level and the format of config to logger
+func configureLogger(logger *logrus.Logger, config LogConfig) error {
+	if config.Level != "" {
+		level, err := logrus.ParseLevel(config.Level)
+		if err != nil {
+			return err
+		}
+		logger.SetLevel(level)
+	}
+	if config.Format == LogFormatJSON {
+		logger.SetFormatter(&redactingFormatter{&logrus.JSONFormatter{}})
+	} else {
+		logger.SetFormatter(&redactingFormatter{&logrus.TextFormatter{FullTimestamp: true}})
+	}
+	return nil
+}
+
+// gormLogger routes the logs of gorm through logrus, the statements at debug level and the errors at error level.
+// The values bound to the statements are left out, as they carry the tokens and the passwords.
+type gormLogger struct {
+	entry *logrus.Entry
+}
+
+func (l gormLogger) Print(values ...interface{}) {
+	if len(values) < 2 {
+		l.entry.Error(values...)
+		return
+	}
+	entry := l.entry.WithField("source", values[1])
+	if values[0] == "sql" && len(values) >= 6 {
+		if l.entry.Logger.IsLevelEnabled(logrus.DebugLevel) {
+			entry.Debugf("%s (%v, %v rows affected)", values[3], values[2], values[5])
+		}
+		return
+	}
+	entry.Error(values[2:]...)
+}
+
+// assignRequestID tags every request with an id, which is sent back in the response and added to its log lines
+func assignRequestID(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(HeaderRequestID)
+		if id == "" || len(id) > 64 {
+			id = uniuri.NewLen(20)
+		}
+		c.Set("requestId", id)
+		c.Response().Header().Set(HeaderRequestID, id)
+		return next(c)
+	}
+}
+
+// requestLog adds the id of the request to the lines logged by logger
+func requestLog(c echo.Context, logger *logrus.Entry) *logrus.Entry {
+	if id, ok := c.Get("requestId").(string); ok {
+		return logger.WithField("request_id", id)
+	}
+	return logger
+}
+
+// logRequests writes the access log, one line per request
+func logRequests(logger *logrus.Entry) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			requestLog(c, logger).WithFields(logrus.Fields{
+				"method":  c.Request().Method,
+				"uri":     c.Request().RequestURI,
+				"route":   c.Path(),
+				"status":  c.Response().Status,
+				"latency": time.Since(start).String(),
+				"ip":      c.RealIP(),
+			}).Info("request handled")
+			return nil
+		}
+	}
+}
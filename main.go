@@ -1,20 +1,21 @@
 package main
 
 import (
+	"flag"
 	"github.com/GalvinGao/floatdream-backend/recaptcha"
 	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/GalvinGao/floatdream-backend/xorpay/xorpaytest"
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/alash3al/go-pubsub"
-	"github.com/davecgh/go-spew/spew"
 	"github.com/jinzhu/configor"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"gopkg.in/go-playground/validator.v9"
-	"log"
 	"net/http"
-	"os"
+	"reflect"
 	"time"
 )
 
@@ -25,20 +26,33 @@ const (
 )
 
 var (
+	// ConfigFile is the path of the config file, reloaded while serving
+	ConfigFile string
+
 	PaySession xorpay.Session
+	PaySandbox *xorpaytest.Server
 
 	WebData    *gorm.DB
 	AuthMeData *gorm.DB
 	GameData   *gorm.DB
 
-	LogDb   *log.Logger
-	LogPay  *log.Logger
-	LogAuth *log.Logger
+	Logger  *logrus.Logger
+	LogDb   *logrus.Entry
+	LogPay  *logrus.Entry
+	LogAuth *logrus.Entry
+	LogHTTP *logrus.Entry
 
 	ReCAPTCHAValidator *recaptcha.Client
 
-	ServerStatusCache   *CachedServerStatus
+	QRCodeRenderer      *QRRenderer
+	GameBalance         GameBalanceConfig
+	Timezone            *time.Location
+	StatsResultCache    *StatsCache
 	RealtimeOrderBroker = pubsub.NewBroker()
+	ServerLifecycle     = NewLifecycle()
+
+	// GameModels are the tables this server maintains in the game database; the web database is versioned by WebMigrations
+	GameModels = []interface{}{&PaidOrder{}}
 
 	DefaultBadRequestResponse = NewErrorResponse(http.StatusBadRequest, ErrorMessageBadRequest)
 )
@@ -99,62 +113,159 @@ func SimulateErrorResponse(next echo.HandlerFunc) echo.HandlerFunc {
 //}
 
 func main() {
-	LogDb = log.New(os.Stdout, "Database", log.Ldate|log.Ltime|log.Lshortfile)
-	LogPay = log.New(os.Stdout, "Payment", log.Ldate|log.Ltime|log.Lshortfile)
-	LogAuth = log.New(os.Stdout, "Authorization", log.Ldate|log.Ltime|log.Lshortfile)
+	flag.StringVar(&ConfigFile, "config", "config.yml", "path of the config file")
+	flag.Usage = printUsage
+	flag.Parse()
+
+	Logger = newLogger()
+	LogDb = Logger.WithField("component", "database")
+	LogPay = Logger.WithField("component", "payment")
+	LogAuth = Logger.WithField("component", "authorization")
+	LogHTTP = Logger.WithField("component", "http")
+
+	if err := runCommand(flag.Args()); err != nil {
+		Logger.Fatal(err)
+	}
+}
 
-	// load configurations
+// readConfig loads the config file, overrides it from the environment and validates it
+func readConfig(file string) (*Config, error) {
 	var config Config
-	err := configor.Load(&config, "config.yml")
-	if err != nil {
-		LogDb.Panic("config file error", err)
+	if err := configor.Load(&config, file); err != nil {
+		return nil, errors.Wrap(err, "config file error")
+	}
+	if err := applyEnvOverrides(reflect.ValueOf(&config).Elem(), ConfigEnvPrefix); err != nil {
+		return nil, errors.Wrap(err, "config environment error")
 	}
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
+	if err := validateSandbox(&config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
 
-	spew.Dump(config)
+// loadConfig reads the config and configures the logger with it
+func loadConfig(file string) (*Config, error) {
+	config, err := readConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := configureLogger(Logger, config.Log); err != nil {
+		return nil, errors.Wrap(err, "log config error")
+	}
+	return config, nil
+}
 
+// initComponents initializes the payment api and the other components configured by config, except the databases
+func initComponents(config *Config) (err error) {
 	// initialize the payment api
-	PaySession = xorpay.New(config.XorPay.NotifyURL, config.XorPay.AppID, config.XorPay.AppSecret)
+	payOptions := []xorpay.Option{xorpay.SetObserver(observePaymentCall)}
+	if config.XorPay.Sandbox {
+		PaySandbox = xorpaytest.NewServer(config.XorPay.AppID, config.XorPay.AppSecret)
+		LogPay.Infof("using sandbox payment platform at %s", PaySandbox.URL)
+		payOptions = append(payOptions, xorpay.SetBaseURL(PaySandbox.URL))
+	} else if config.XorPay.BaseURL != "" {
+		payOptions = append(payOptions, xorpay.SetBaseURL(config.XorPay.BaseURL))
+	}
+	PaySession = xorpay.New(config.XorPay.NotifyURL, config.XorPay.AppID, config.XorPay.AppSecret, payOptions...)
 
 	// initialize the ReCAPTCHA validator
 	ReCAPTCHAValidator = recaptcha.New(config.ReCAPTCHA.Secret)
 
-	// initialize the server status getter
-	ServerStatusCache = NewStatusCache(config.Game.Address, time.Minute*5)
+	// load the urls, the promotions, the rules checked before placing orders and the other reloadable settings
+	loadedSettings.Store(NewSettings(config))
 
-	// initialize database connection
-	if WebData, err = gorm.Open(config.Database.Web.Source, config.Database.Web.DSN); err != nil {
-		LogDb.Panic("failed to open database: `web`;", err)
+	// initialize the qr code renderer of the payment qr codes
+	if QRCodeRenderer, err = NewQRRenderer(config.QRCode.Size, config.QRCode.Level, config.QRCode.Logo); err != nil {
+		return errors.Wrap(err, "qr code config error")
 	}
 
-	// initialize database tables
-	WebData.AutoMigrate(&Token{}, &Order{})
+	// load the timezone the days begin in
+	timezone := config.Server.Timezone
+	if timezone == "" {
+		timezone = DefaultTimezone
+	}
+	if Timezone, err = time.LoadLocation(timezone); err != nil {
+		return errors.Wrap(err, "timezone config error")
+	}
+	StatsResultCache = NewStatsCache(config.Stats.CacheTTL)
+
+	// load the game balance location used when debiting refunded orders
+	GameBalance = config.Game.Balance
+	return nil
+}
+
+// openDatabases connects the web, authme and game databases
+func openDatabases(config *Config) (err error) {
+	if WebData, err = gorm.Open(config.Database.Web.Source, config.Database.Web.DSN); err != nil {
+		return errors.Wrap(err, "failed to open database: `web`")
+	}
 
 	if AuthMeData, err = gorm.Open(config.Database.AuthMe.Source, config.Database.AuthMe.DSN); err != nil {
-		LogDb.Panic("failed to open database: `authme`;", err)
+		return errors.Wrap(err, "failed to open database: `authme`")
 	}
 
 	// check if the table exists or not
 	if !AuthMeData.HasTable(&AuthMeUser{}) {
-		LogDb.Panic("expect to see table `authme` in database `authme`")
+		return errors.New("expect to see table `authme` in database `authme`")
 	}
 
 	if GameData, err = gorm.Open(config.Database.Game.Source, config.Database.Game.DSN); err != nil {
-		LogDb.Panic("failed to open database: `game`;", err)
+		return errors.Wrap(err, "failed to open database: `game`")
 	}
 
-	//GameData.AutoMigrate(&PaidOrder{})
+	for _, db := range []*gorm.DB{WebData, AuthMeData, GameData} {
+		db.SetLogger(gormLogger{LogDb})
+		db.LogMode(true)
+	}
+	return nil
+}
 
-	e := echo.New()
-	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "${time_rfc3339} | ${status} ${method} ${uri} ${latency_human}\n",
-	}))
-	if config.Server.CORS.Enabled {
-		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-			AllowOrigins: config.Server.CORS.AllowOrigins,
-			AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
-		}))
+// migrateDatabases applies the pending WebMigrations, then creates the tables of GameModels and adds their missing columns
+func migrateDatabases() error {
+	applied, err := migrateUp(WebData, WebMigrations)
+	if err != nil {
+		return errors.Wrap(err, "migrate database `web` error")
+	}
+	LogDb.Infof("%d migrations applied to database `web`", applied)
+	if err := GameData.AutoMigrate(GameModels...).Error; err != nil {
+		return errors.Wrap(err, "migrate database `game` error")
+	}
+	return nil
+}
+
+// serve runs the http server until the process is asked to terminate
+func serve(config *Config) error {
+	if printed, err := redactConfig(config); err == nil {
+		LogHTTP.Infof("serving with config:\n%s", printed)
+	}
+
+	// measure the game server once, so that its latency is reported from the start
+	currentSettings().ServerStatus.Get()
+
+	// expose the metrics of the databases and the other components initialized above
+	registerMetrics()
+
+	// reconcile the unpaid orders against the payment platform in the background
+	if config.Reconcile.Interval > 0 {
+		window := config.Reconcile.Window
+		if window == 0 {
+			window = DefaultReconcileWindow
+		}
+		startReconcileJob(ServerLifecycle, config.Reconcile.Interval, window)
 	}
 
+	// apply the changes of the config file without restarting
+	ServerLifecycle.Go(NewConfigReloader(ConfigFile, config).Watch)
+
+	e := echo.New()
+	e.Use(assignRequestID)
+	e.Use(logRequests(LogHTTP))
+	e.Use(observeRequests)
+	e.Use(applyCORS)
+
 	e.Validator = &Validator{
 		validator: validator.New(),
 	}
@@ -162,6 +273,9 @@ func main() {
 	assetHandler := http.FileServer(rice.MustFindBox("ui").HTTPBox())
 	e.GET("/", echo.WrapHandler(assetHandler))
 	e.GET("/assets/*", echo.WrapHandler(assetHandler))
+	e.GET("/metrics", serveMetrics(config.Metrics.Token))
+	e.GET("/healthz", checkLiveness)
+	e.GET("/readyz", checkReadiness(NewReadinessChecks(config.Health.CheckPayment)))
 
 	api := e.Group("/api")
 	{
@@ -177,15 +291,25 @@ func main() {
 		topup := api.Group("/topup")
 		{
 			topup.GET("/item", itemDetails)
+			topup.POST("/redeem", redeemGiftCoupon, needValidation)
+			topup.GET("/wechat/openid", requestWeChatOpenID, needValidation)
+			topup.GET("/wechat/openid/callback", receiveWeChatOpenID)
+			topup.GET("/order/:orderId/return", landOrderReturn)
 			order := topup.Group("/order", needValidation)
 			{
 				order.GET("", listOrder)
 				order.GET("/:orderId/status", queryOrderStatus)
 				order.GET("/:orderId/polling", pollOrderStatus)
+				order.GET("/:orderId/qr.png", renderOrderQRCode(QRFormatPNG, "image/png"))
+				order.GET("/:orderId/qr.svg", renderOrderQRCode(QRFormatSVG, "image/svg+xml"))
 				order.POST("", placeOrder)
-				order.POST("/callback", storeOrder)
+				if PaySandbox != nil {
+					order.POST("/:orderId/sandbox/pay", payOrderInSandbox)
+				}
 			}
-			h := topup.GET("/testsse", func(c echo.Context) error {
+			// notifications come from the payment platform, which could not be validated as a user
+			topup.POST("/order/callback", storeOrder)
+			topup.GET("/testsse", func(c echo.Context) error {
 				RealtimeOrderBroker.Broadcast(&Order{
 					OrderID:        c.QueryParam("orderId"),
 					ParentUsername: c.QueryParam("parentUsername"),
@@ -193,7 +317,39 @@ func main() {
 
 				return c.NoContent(http.StatusOK)
 			})
-			spew.Dump(h)
+		}
+
+		api.POST("/admin/login", validateAdmin)
+		admin := api.Group("/admin", needToken, needAdmin)
+		{
+			admin.GET("/me", retrieveAdminInfo)
+			admin.POST("/logout", invalidateUser)
+			admin.GET("/order", searchOrders, needPermission(PermissionOrdersRead))
+			admin.GET("/order/export", exportOrders, needPermission(PermissionOrdersRead))
+			admin.GET("/order/:orderId", getOrderDetail, needPermission(PermissionOrdersRead))
+			admin.GET("/notifications", searchNotifications, needPermission(PermissionOrdersRead))
+			admin.POST("/order/:orderId/refund", refundOrder, needPermission(PermissionOrdersRefund))
+			admin.POST("/order/:orderId/mark-paid", markOrderPaid, needPermission(PermissionOrdersManage))
+			admin.POST("/order/:orderId/retry-delivery", retryOrderDelivery, needPermission(PermissionOrdersManage))
+			admin.POST("/order/:orderId/mark-delivered", markOrderDelivered, needPermission(PermissionOrdersManage))
+			admin.POST("/order/:orderId/cancel", cancelOrder, needPermission(PermissionOrdersManage))
+			admin.POST("/user/:username/compensation", compensateUser, needPermission(PermissionOrdersManage))
+			admin.POST("/reconcile", reconcileOrdersNow, needPermission(PermissionReconcile))
+			admin.GET("/user/:username/protection", getAccountProtection, needPermission(PermissionUsersProtect))
+			admin.PUT("/user/:username/protection", setAccountProtection, needPermission(PermissionUsersProtect))
+			admin.DELETE("/user/:username/protection", removeAccountProtection, needPermission(PermissionUsersProtect))
+			admin.GET("/blocked-orders/export", exportBlockedOrders, needPermission(PermissionRiskExport))
+			admin.GET("/stats/revenue", getRevenueStats, needPermission(PermissionStats))
+			admin.GET("/stats/pay-types", getPayTypeStats, needPermission(PermissionStats))
+			admin.GET("/stats/summary", getSalesSummary, needPermission(PermissionStats))
+			admin.GET("/audit", queryAuditLog, needPermission(PermissionAudit))
+			admin.GET("/audit/verify", verifyAuditLogNow, needPermission(PermissionAudit))
+			admin.POST("/coupons", generateCouponBatch, needPermission(PermissionCoupons))
+			admin.GET("/roles", listAdminRoles, needPermission(PermissionRolesManage))
+			admin.PUT("/roles/:username", grantAdminRole, needPermission(PermissionRolesManage))
+			admin.DELETE("/roles/:username", revokeAdminRole, needPermission(PermissionRolesManage))
+			admin.POST("/accounts", createAdminAccount, needPermission(PermissionRolesManage))
+			admin.DELETE("/accounts/:username", deleteAdminAccount, needPermission(PermissionRolesManage))
 		}
 	}
 
@@ -212,5 +368,22 @@ func main() {
 	//	return c.Blob(http.StatusOK, "text/html", file)
 	//})
 
-	log.Fatalln(e.Start(config.Server.Address))
+	go func() {
+		if err := e.Start(config.Server.Address); err != nil && err != http.ErrServerClosed {
+			LogHTTP.Fatal(err)
+		}
+	}()
+
+	// drain the requests and stop the jobs before closing the databases they use
+	sig := waitForSignal()
+	shutdownTimeout := config.Server.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	LogHTTP.Infof("received %s, shutting down within %s", sig, shutdownTimeout)
+	if err := ServerLifecycle.Shutdown(e, shutdownTimeout); err != nil {
+		LogHTTP.Errorf("shutdown error: %v", err)
+	}
+	LogHTTP.Info("shutdown complete")
+	return nil
 }
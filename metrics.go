@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	MetricsNamespace = "floatdream"
+
+	OrderEventCreated   = "created"
+	OrderEventPaid      = "paid"
+	OrderEventDelivered = "delivered"
+	OrderEventFailed    = "delivery_failed"
+
+	CaptchaOutcomeSuccess = "success"
+	CaptchaOutcomeFailure = "failure"
+	CaptchaOutcomeError   = "error"
+
+	PaymentErrorTimeout = "timeout"
+	PaymentErrorNetwork = "network"
+	PaymentErrorStatus  = "status"
+	PaymentErrorOther   = "other"
+)
+
+var (
+	// paymentErrorLabels are the labels of the errors returned by the payment platform
+	paymentErrorLabels = map[error]string{
+		xorpay.ErrPlatformUnavailable: "platform_unavailable",
+		xorpay.ErrBadResponse:         "bad_response",
+		xorpay.ErrRequestRejected:     "request_rejected",
+		xorpay.ErrSignRejected:        "sign_rejected",
+		xorpay.ErrMissingArgument:     "missing_argument",
+		xorpay.ErrOrderExists:         "order_exists",
+		xorpay.ErrOrderNotFound:       "order_not_found",
+		xorpay.ErrOrderPaid:           "order_paid",
+		xorpay.ErrOrderNotPaid:        "order_not_paid",
+		xorpay.ErrPriceInvalid:        "price_invalid",
+	}
+
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests, by route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	ordersTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "orders_total",
+		Help:      "Orders created, paid, delivered and failed to be delivered, by pay type.",
+	}, []string{"event", "pay_type"})
+
+	paymentCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "payment_call_duration_seconds",
+		Help:      "Latency of the calls to the payment platform, by api.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api"})
+
+	paymentCallErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "payment_call_errors_total",
+		Help:      "Failed calls to the payment platform, by api and error.",
+	}, []string{"api", "error"})
+
+	captchaVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "captcha_verifications_total",
+		Help:      "reCAPTCHA verifications, by outcome.",
+	}, []string{"outcome"})
+
+	sseSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace,
+		Name:      "sse_subscribers",
+		Help:      "Clients currently subscribed to the order status events.",
+	})
+)
+
+// dbStatsCollector exports the connection pool statistics of the gorm connections
+type dbStatsCollector struct {
+	databases map[string]*gorm.DB
+
+	openConnections *prometheus.Desc
+	inUse           *prometheus.Desc
+	idle            *prometheus.Desc
+	waitCount       *prometheus.Desc
+	waitDuration    *prometheus.Desc
+}
+
+func newDBStatsCollector(databases map[string]*gorm.DB) *dbStatsCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "db", name), help, []string{"db"}, nil)
+	}
+	return &dbStatsCollector{
+		databases:       databases,
+		openConnections: desc("open_connections", "Established connections, both in use and idle."),
+		inUse:           desc("in_use_connections", "Connections currently in use."),
+		idle:            desc("idle_connections", "Idle connections."),
+		waitCount:       desc("wait_count_total", "Connections waited for."),
+		waitDuration:    desc("wait_duration_seconds_total", "Time blocked waiting for a connection."),
+	}
+}
+
+func (d *dbStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- d.openConnections
+	ch <- d.inUse
+	ch <- d.idle
+	ch <- d.waitCount
+	ch <- d.waitDuration
+}
+
+func (d *dbStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, db := range d.databases {
+		stats := db.DB().Stats()
+		ch <- prometheus.MustNewConstMetric(d.openConnections, prometheus.GaugeValue, float64(stats.OpenConnections), name)
+		ch <- prometheus.MustNewConstMetric(d.inUse, prometheus.GaugeValue, float64(stats.InUse), name)
+		ch <- prometheus.MustNewConstMetric(d.idle, prometheus.GaugeValue, float64(stats.Idle), name)
+		ch <- prometheus.MustNewConstMetric(d.waitCount, prometheus.CounterValue, float64(stats.WaitCount), name)
+		ch <- prometheus.MustNewConstMetric(d.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds(), name)
+	}
+}
+
+// registerMetrics registers the collectors. Has to be called once the databases and the server status cache are ready.
+func registerMetrics() {
+	prometheus.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		ordersTotal,
+		paymentCallDuration,
+		paymentCallErrors,
+		captchaVerifications,
+		sseSubscribers,
+		newDBStatsCollector(map[string]*gorm.DB{
+			"web":    WebData,
+			"authme": AuthMeData,
+			"game":   GameData,
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "game_server_latency_seconds",
+			Help:      "Latency of the game server last measured by the status cache, -1 when unreachable.",
+		}, func() float64 {
+			latency := currentSettings().ServerStatus.Latency()
+			if latency < 0 {
+				return -1
+			}
+			return time.Duration(latency).Seconds()
+		}),
+	)
+}
+
+// observeRequests measures every request by its route pattern, so that path parameters don't explode the labels
+func observeRequests(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		status := c.Response().Status
+		if httpError, ok := err.(*echo.HTTPError); ok {
+			status = httpError.Code
+		} else if err != nil && !c.Response().Committed {
+			status = http.StatusInternalServerError
+		}
+		method := c.Request().Method
+		route := c.Path()
+		httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// paymentErrorLabel maps err to one of a fixed set of labels, so that the messages carried by the errors don't
+// explode the labels
+func paymentErrorLabel(err error) string {
+	if transportErr, ok := err.(*xorpay.TransportError); ok {
+		if transportErr.Timeout() {
+			return PaymentErrorTimeout
+		}
+		return PaymentErrorNetwork
+	}
+	if label, ok := paymentErrorLabels[errors.Cause(err)]; ok {
+		return label
+	}
+	if _, ok := errors.Cause(err).(*xorpay.StatusError); ok {
+		return PaymentErrorStatus
+	}
+	return PaymentErrorOther
+}
+
+// observePaymentCall is the xorpay.CallObserver feeding the payment platform metrics
+func observePaymentCall(api string, duration time.Duration, err error) {
+	paymentCallDuration.WithLabelValues(api).Observe(duration.Seconds())
+	if err != nil {
+		paymentCallErrors.WithLabelValues(api, paymentErrorLabel(err)).Inc()
+	}
+}
+
+func countOrder(event string, order *Order) {
+	ordersTotal.WithLabelValues(event, order.PayType).Inc()
+}
+
+// serveMetrics exposes the metrics to the scrapers presenting token as bearer, or to anyone if token is empty
+func serveMetrics(token string) echo.HandlerFunc {
+	handler := echo.WrapHandler(promhttp.Handler())
+	return func(c echo.Context) error {
+		presented := []byte(c.Request().Header.Get("authorization"))
+		if token != "" && subtle.ConstantTimeCompare(presented, []byte("Bearer "+token)) != 1 {
+			return NewErrorResponse(http.StatusUnauthorized, ErrorMessageNeedAuthorization)
+		}
+		return handler(c)
+	}
+}
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+const (
+	MigrationTable = "schema_migrations"
+	// MigrationLockName is the MySQL named lock held while migrating, so that two processes never migrate at once
+	MigrationLockName = "floatdream_schema_migrations"
+	// MigrationLockTimeout is how long to wait for the lock held by another process, in seconds
+	MigrationLockTimeout = 30
+)
+
+var (
+	ErrMigrationLocked = errors.New("another process is running the migrations")
+)
+
+// Migration changes the schema from the previous version to Version. Up and Down are run statement by statement;
+// MySQL commits the DDL statements implicitly, so a failed migration has to be fixed by hand before running again.
+type Migration struct {
+	Version string
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Checksum identifies the statements of Up, so that editing a migration already applied is detected
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(strings.Join(m.Up, ";\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// SchemaMigration records a migration applied to the database
+type SchemaMigration struct {
+	Version   string    `gorm:"size:16;primary_key" json:"version"`
+	Name      string    `gorm:"size:255;NOT NULL" json:"name"`
+	Checksum  string    `gorm:"size:64;NOT NULL" json:"checksum"`
+	AppliedAt time.Time `gorm:"NOT NULL" json:"applied_at"`
+}
+
+func (m *SchemaMigration) TableName() string {
+	return MigrationTable
+}
+
+type MigrationStatus struct {
+	Version   string     `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+func (s MigrationStatus) String() string {
+	if !s.Applied {
+		return fmt.Sprintf("%s %-40s pending", s.Version, s.Name)
+	}
+	return fmt.Sprintf("%s %-40s applied at %s", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+}
+
+func ensureMigrationTable(db *gorm.DB) error {
+	return db.Exec("CREATE TABLE IF NOT EXISTS `" + MigrationTable + "` (" +
+		"`version` varchar(16) NOT NULL, " +
+		"`name` varchar(255) NOT NULL, " +
+		"`checksum` varchar(64) NOT NULL, " +
+		"`applied_at` datetime NOT NULL, " +
+		"PRIMARY KEY (`version`))").Error
+}
+
+// appliedMigrations finds the migrations applied to db, checking that each of them is one of migrations, unchanged
+func appliedMigrations(db *gorm.DB, migrations []Migration) (map[string]SchemaMigration, error) {
+	var records []SchemaMigration
+	if err := db.Order("version ASC").Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]*Migration, len(migrations))
+	for i := range migrations {
+		known[migrations[i].Version] = &migrations[i]
+	}
+	applied := make(map[string]SchemaMigration, len(records))
+	for _, record := range records {
+		migration, ok := known[record.Version]
+		if !ok {
+			return nil, fmt.Errorf("migration %s is applied but unknown to this build", record.Version)
+		}
+		if migration.Checksum() != record.Checksum {
+			return nil, fmt.Errorf("migration %s has been changed since applied", record.Version)
+		}
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// lockMigrations takes the named lock on a connection of its own, which has to be kept until unlocked
+func lockMigrations(db *gorm.DB) (unlock func(), err error) {
+	ctx := context.Background()
+	conn, err := db.DB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var acquired sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", MigrationLockName, MigrationLockTimeout).Scan(&acquired)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		conn.Close()
+		return nil, ErrMigrationLocked
+	}
+	return func() {
+		var released sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", MigrationLockName).Scan(&released); err != nil {
+			LogDb.Errorf("release migration lock error: %v", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+func runMigrationStatements(db *gorm.DB, migration *Migration, statements []string) error {
+	for i, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return errors.Wrapf(err, "migration %s statement %d", migration.Version, i+1)
+		}
+	}
+	return nil
+}
+
+// migrateUp applies the pending migrations in order, returning how many have been applied
+func migrateUp(db *gorm.DB, migrations []Migration) (int, error) {
+	if err := ensureMigrationTable(db); err != nil {
+		return 0, err
+	}
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(db, migrations)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := range migrations {
+		migration := &migrations[i]
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		LogDb.Infof("applying migration %s %s", migration.Version, migration.Name)
+		if err := runMigrationStatements(db, migration, migration.Up); err != nil {
+			return count, err
+		}
+		err := db.Create(&SchemaMigration{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Checksum:  migration.Checksum(),
+			AppliedAt: time.Now(),
+		}).Error
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// migrateDown reverts the last steps migrations applied, returning how many have been reverted
+func migrateDown(db *gorm.DB, migrations []Migration, steps int) (int, error) {
+	if err := ensureMigrationTable(db); err != nil {
+		return 0, err
+	}
+	unlock, err := lockMigrations(db)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	applied, err := appliedMigrations(db, migrations)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := &migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		LogDb.Infof("reverting migration %s %s", migration.Version, migration.Name)
+		if err := runMigrationStatements(db, migration, migration.Down); err != nil {
+			return count, err
+		}
+		if err := db.Where("version = ?", migration.Version).Delete(&SchemaMigration{}).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// migrationStatus lists migrations along with whether they have been applied to db
+func migrationStatus(db *gorm.DB, migrations []Migration) ([]MigrationStatus, error) {
+	applied := map[string]SchemaMigration{}
+	if db.HasTable(&SchemaMigration{}) {
+		var err error
+		if applied, err = appliedMigrations(db, migrations); err != nil {
+			return nil, err
+		}
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		status := MigrationStatus{
+			Version: migration.Version,
+			Name:    migration.Name,
+		}
+		if record, ok := applied[migration.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// pendingMigrations counts the migrations not applied to db yet
+func pendingMigrations(db *gorm.DB, migrations []Migration) (int, error) {
+	statuses, err := migrationStatus(db, migrations)
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// WebMigrations are the versions of the schema of the web database, in order.
+// Never edit a migration once released; add a new one instead.
+var WebMigrations = []Migration{
+	{
+		// exactly the schema created by AutoMigrate until the migrations were introduced, which existing databases
+		// already have; the tables are created only on new databases. Later changes are altered in by the next ones.
+		Version: "0001",
+		Name:    "initial schema",
+		Up: []string{
+			"CREATE TABLE IF NOT EXISTS `tokens` (" +
+				"`token` varchar(255) NOT NULL, " +
+				"`expire_at` datetime NULL, " +
+				"`parent_username` varchar(255), " +
+				"PRIMARY KEY (`token`))",
+			"CREATE TABLE IF NOT EXISTS `orders` (" +
+				"`order_id` varchar(32) NOT NULL, " +
+				"`platform_order_id` varchar(32) NOT NULL, " +
+				"`parent_username` varchar(255) NOT NULL, " +
+				"`pay_type` varchar(32) NOT NULL, " +
+				"`created_at` datetime NOT NULL, " +
+				"`paid_price` bigint unsigned NOT NULL, " +
+				"`paid_at` datetime NULL, " +
+				"`transaction_id` varchar(64), " +
+				"`transaction_type` varchar(64), " +
+				"`processed_at` datetime NULL, " +
+				"UNIQUE INDEX `uix_orders_order_id` (`order_id`), " +
+				"UNIQUE INDEX `uix_orders_platform_order_id` (`platform_order_id`), " +
+				"INDEX `idx_orders_parent_username` (`parent_username`))",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS `orders`",
+			"DROP TABLE IF EXISTS `tokens`",
+		},
+	},
+	{
+		Version: "0002",
+		Name:    "wechat openid of tokens",
+		Up: []string{
+			"ALTER TABLE `tokens` " +
+				"ADD COLUMN `wechat_openid` varchar(64), " +
+				"ADD COLUMN `openid_state` varchar(32)",
+			"CREATE INDEX `idx_tokens_openid_state` ON `tokens` (`openid_state`)",
+		},
+		Down: []string{
+			"DROP INDEX `idx_tokens_openid_state` ON `tokens`",
+			"ALTER TABLE `tokens` DROP COLUMN `openid_state`, DROP COLUMN `wechat_openid`",
+		},
+	},
+	{
+		Version: "0003",
+		Name:    "order status, promotions, coupons, review and refunds",
+		Up: []string{
+			"ALTER TABLE `orders` " +
+				"ADD COLUMN `qr_content` varchar(512) AFTER `pay_type`, " +
+				"ADD COLUMN `client_ip` varchar(64) AFTER `qr_content`, " +
+				"ADD COLUMN `review_reason` varchar(255) AFTER `client_ip`, " +
+				"ADD COLUMN `status` varchar(16) NOT NULL DEFAULT 'created' AFTER `review_reason`, " +
+				"ADD COLUMN `promotion_id` varchar(64) AFTER `paid_at`, " +
+				"ADD COLUMN `bonus_coins` bigint unsigned NOT NULL DEFAULT 0 AFTER `promotion_id`, " +
+				"ADD COLUMN `coupon_code` varchar(32) AFTER `bonus_coins`, " +
+				"ADD COLUMN `discount_price` bigint unsigned NOT NULL DEFAULT 0 AFTER `coupon_code`, " +
+				"ADD COLUMN `refund_price` bigint unsigned NOT NULL DEFAULT 0, " +
+				"ADD COLUMN `refund_reason` varchar(255), " +
+				"ADD COLUMN `refund_shortfall` bigint unsigned NOT NULL DEFAULT 0, " +
+				"ADD COLUMN `refunded_at` datetime NULL",
+			"CREATE INDEX `idx_orders_client_ip` ON `orders` (`client_ip`)",
+			"CREATE INDEX `idx_orders_status` ON `orders` (`status`)",
+			"CREATE INDEX `idx_orders_coupon_code` ON `orders` (`coupon_code`)",
+		},
+		Down: []string{
+			"DROP INDEX `idx_orders_coupon_code` ON `orders`",
+			"DROP INDEX `idx_orders_status` ON `orders`",
+			"DROP INDEX `idx_orders_client_ip` ON `orders`",
+			"ALTER TABLE `orders` " +
+				"DROP COLUMN `refunded_at`, " +
+				"DROP COLUMN `refund_shortfall`, " +
+				"DROP COLUMN `refund_reason`, " +
+				"DROP COLUMN `refund_price`, " +
+				"DROP COLUMN `discount_price`, " +
+				"DROP COLUMN `coupon_code`, " +
+				"DROP COLUMN `bonus_coins`, " +
+				"DROP COLUMN `promotion_id`, " +
+				"DROP COLUMN `status`, " +
+				"DROP COLUMN `review_reason`, " +
+				"DROP COLUMN `client_ip`, " +
+				"DROP COLUMN `qr_content`",
+		},
+	},
+	{
+		Version: "0004",
+		Name:    "coupons, notifications, risk, admin and audit tables",
+		Up: []string{
+			"CREATE TABLE `coupons` (" +
+				"`code` varchar(32) NOT NULL, " +
+				"`batch` varchar(64) NOT NULL, " +
+				"`type` varchar(32) NOT NULL, " +
+				"`value` bigint unsigned NOT NULL, " +
+				"`max_uses` int unsigned NOT NULL DEFAULT 1, " +
+				"`user_limit` int unsigned NOT NULL DEFAULT 1, " +
+				"`used` int unsigned NOT NULL DEFAULT 0, " +
+				"`expire_at` datetime NULL, " +
+				"`created_at` datetime NULL, " +
+				"PRIMARY KEY (`code`), " +
+				"INDEX `idx_coupons_batch` (`batch`))",
+			"CREATE TABLE `coupon_redemptions` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`coupon_code` varchar(32) NOT NULL, " +
+				"`username` varchar(255) NOT NULL, " +
+				"`order_id` varchar(32), " +
+				"`created_at` datetime NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"INDEX `idx_coupon_redemptions_coupon_code` (`coupon_code`), " +
+				"INDEX `idx_coupon_redemptions_username` (`username`))",
+			"CREATE TABLE `payment_notifications` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`platform_order_id` varchar(32) NOT NULL, " +
+				"`order_id` varchar(32), " +
+				"`pay_price` varchar(32), " +
+				"`pay_time` varchar(32), " +
+				"`sign` varchar(64), " +
+				"`detail` text, " +
+				"`remote_ip` varchar(64), " +
+				"`result` varchar(32) NOT NULL, " +
+				"`received_at` datetime NOT NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"INDEX `idx_payment_notifications_platform_order_id` (`platform_order_id`), " +
+				"INDEX `idx_payment_notifications_order_id` (`order_id`))",
+			"CREATE TABLE `blocked_orders` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`username` varchar(255) NOT NULL, " +
+				"`client_ip` varchar(64), " +
+				"`price` bigint unsigned NOT NULL, " +
+				"`pay_type` varchar(32), " +
+				"`rule` varchar(64), " +
+				"`reason` varchar(255), " +
+				"`created_at` datetime NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"INDEX `idx_blocked_orders_username` (`username`), " +
+				"INDEX `idx_blocked_orders_rule` (`rule`), " +
+				"INDEX `idx_blocked_orders_created_at` (`created_at`))",
+			"CREATE TABLE `account_protections` (" +
+				"`username` varchar(255) NOT NULL, " +
+				"`age_group` varchar(32) NOT NULL, " +
+				"`guardian` varchar(255), " +
+				"`note` varchar(255), " +
+				"`updated_by` varchar(255), " +
+				"`updated_at` datetime NULL, " +
+				"PRIMARY KEY (`username`))",
+			"CREATE TABLE `admin_roles` (" +
+				"`username` varchar(255) NOT NULL, " +
+				"`role` varchar(32) NOT NULL, " +
+				"`granted_by` varchar(255), " +
+				"`granted_at` datetime NULL, " +
+				"PRIMARY KEY (`username`))",
+			"CREATE TABLE `admin_accounts` (" +
+				"`username` varchar(64) NOT NULL, " +
+				"`password` varchar(255) NOT NULL, " +
+				"`role` varchar(32) NOT NULL, " +
+				"`created_at` datetime NULL, " +
+				"PRIMARY KEY (`username`))",
+			"CREATE TABLE `delivery_attempts` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`order_id` varchar(32) NOT NULL, " +
+				"`succeeded` boolean, " +
+				"`error` text, " +
+				"`attempted_at` datetime NOT NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"INDEX `idx_delivery_attempts_order_id` (`order_id`))",
+			"CREATE TABLE `audit_entries` (" +
+				"`id` int unsigned AUTO_INCREMENT, " +
+				"`actor` varchar(255) NOT NULL, " +
+				"`action` varchar(64) NOT NULL, " +
+				"`target` varchar(255), " +
+				"`reason` varchar(255), " +
+				"`ip` varchar(64), " +
+				"`user_agent` varchar(512), " +
+				"`before` text, " +
+				"`after` text, " +
+				"`created_at` datetime NOT NULL, " +
+				"`prev_hash` varchar(64) NOT NULL, " +
+				"`hash` varchar(64) NOT NULL, " +
+				"PRIMARY KEY (`id`), " +
+				"UNIQUE INDEX `uix_audit_entries_hash` (`hash`), " +
+				"INDEX `idx_audit_entries_actor` (`actor`), " +
+				"INDEX `idx_audit_entries_action` (`action`), " +
+				"INDEX `idx_audit_entries_target` (`target`), " +
+				"INDEX `idx_audit_entries_created_at` (`created_at`))",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS `audit_entries`",
+			"DROP TABLE IF EXISTS `delivery_attempts`",
+			"DROP TABLE IF EXISTS `admin_accounts`",
+			"DROP TABLE IF EXISTS `admin_roles`",
+			"DROP TABLE IF EXISTS `account_protections`",
+			"DROP TABLE IF EXISTS `blocked_orders`",
+			"DROP TABLE IF EXISTS `payment_notifications`",
+			"DROP TABLE IF EXISTS `coupon_redemptions`",
+			"DROP TABLE IF EXISTS `coupons`",
+		},
+	},
+	{
+		// the orders existing before 0003 all got the default status, which is derived from their timestamps here.
+		// the unpaid ones are cancelled once their qr code or cashier page has expired, after 2 hours.
+		Version: "0005",
+		Name:    "backfill order status",
+		Up: []string{
+			"UPDATE `orders` SET `status` = 'delivered' " +
+				"WHERE `status` = 'created' AND `processed_at` IS NOT NULL",
+			"UPDATE `orders` SET `status` = 'paid' " +
+				"WHERE `status` = 'created' AND `paid_at` IS NOT NULL AND `processed_at` IS NULL",
+			"UPDATE `orders` SET `status` = 'cancelled' " +
+				"WHERE `status` = 'created' AND `paid_at` IS NULL AND `created_at` < NOW() - INTERVAL 2 HOUR",
+		},
+		// nothing to revert, the statuses are kept consistent with the timestamps
+		Down: []string{},
+	},
+	{
+		Version: "0006",
+		Name:    "user locks",
+		Up: []string{
+			"CREATE TABLE `user_locks` (" +
+				"`username` varchar(255) NOT NULL, " +
+				"PRIMARY KEY (`username`))",
+		},
+		Down: []string{
+			"DROP TABLE IF EXISTS `user_locks`",
+		},
+	},
+	{
+		Version: "0007",
+		Name:    "order promotion type",
+		Up: []string{
+			"ALTER TABLE `orders` ADD COLUMN `promotion_type` varchar(32) AFTER `promotion_id`",
+		},
+		Down: []string{
+			"ALTER TABLE `orders` DROP COLUMN `promotion_type`",
+		},
+	},
+}
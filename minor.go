@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ErrorMessageAgeGroupUnknown = "未知的年龄分组"
+)
+
+// MinorGroup configures the top-up limits of the accounts flagged with its name. Zero disables a limit.
+type MinorGroup struct {
+	Name           string `yaml:"name"`
+	Forbidden      bool   `yaml:"forbidden"`
+	MaxSingleOrder uint64 `yaml:"maxSingleOrder"`
+	MonthlyCap     uint64 `yaml:"monthlyCap"`
+}
+
+// AccountProtection flags an account as owned by a minor, whose top-ups are limited by the MinorGroup of AgeGroup
+type AccountProtection struct {
+	Username  string    `gorm:"size:255;primary_key" json:"username"`
+	AgeGroup  string    `gorm:"size:32;NOT NULL" json:"age_group"`
+	Guardian  string    `gorm:"size:255" json:"guardian"`
+	Note      string    `gorm:"size:255" json:"note"`
+	UpdatedBy string    `gorm:"size:255" json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type AccountProtectionRequest struct {
+	AgeGroup string `json:"age_group" validate:"required,max=32"`
+	Guardian string `json:"guardian" validate:"max=255"`
+	Note     string `json:"note" validate:"max=255"`
+}
+
+// BlockedOrderExportRequest filters the blocked orders exported. From and To are dates formatted as 2006-01-02 in Timezone.
+type BlockedOrderExportRequest struct {
+	Rule string `query:"rule" validate:"max=64"`
+	From string `query:"from" validate:"omitempty,len=10"`
+	To   string `query:"to" validate:"omitempty,len=10"`
+}
+
+func findMinorGroup(groups []MinorGroup, name string) *MinorGroup {
+	for i := range groups {
+		if groups[i].Name == name {
+			return &groups[i]
+		}
+	}
+	return nil
+}
+
+// NewMinorProtectionRule builds the rule limiting the top-ups of the accounts flagged as minors
+func NewMinorProtectionRule(groups []MinorGroup) OrderRule {
+	return OrderRule{
+		Name: "minor_protection",
+		Check: func(attempt *OrderAttempt) (RiskDecision, error) {
+			var protection AccountProtection
+			err := WebData.Where("username = ?", attempt.Username).First(&protection).Error
+			if gorm.IsRecordNotFoundError(err) {
+				return RiskDecision{Action: RiskActionAllow}, nil
+			} else if err != nil {
+				return RiskDecision{}, err
+			}
+
+			group := findMinorGroup(groups, protection.AgeGroup)
+			switch {
+			case group == nil:
+				// the group has been removed from the config, be strict about it
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: "未成年人账号暂时无法充值",
+				}, nil
+			case group.Forbidden:
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: "根据未成年人保护规定，该账号无法充值",
+				}, nil
+			case group.MaxSingleOrder != 0 && attempt.Price > group.MaxSingleOrder:
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: fmt.Sprintf("根据未成年人保护规定，单笔充值不能超过 %d", group.MaxSingleOrder),
+				}, nil
+			}
+
+			if group.MonthlyCap != 0 {
+				spent, err := spentSince(attempt.Username, startOfMonth(attempt.At))
+				if err != nil {
+					return RiskDecision{}, err
+				}
+				if spent+attempt.Price > group.MonthlyCap {
+					return RiskDecision{
+						Action: RiskActionReject,
+						Reason: fmt.Sprintf("根据未成年人保护规定，每月充值不能超过 %d", group.MonthlyCap),
+					}, nil
+				}
+			}
+
+			return RiskDecision{Action: RiskActionAllow}, nil
+		},
+	}
+}
+
+func getAccountProtection(c echo.Context) error {
+	var protection AccountProtection
+	err := WebData.Where("username = ?", c.Param("username")).First(&protection).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return c.NoContent(http.StatusNoContent)
+	} else if err != nil {
+		requestLog(c, LogDb).Errorf("find account protection error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return c.JSON(http.StatusOK, protection)
+}
+
+func setAccountProtection(c echo.Context) error {
+	var form AccountProtectionRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogAuth).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if findMinorGroup(currentSettings().MinorGroups, form.AgeGroup) == nil {
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageAgeGroupUnknown)
+	}
+
+	var before interface{}
+	var existing AccountProtection
+	if WebData.Where("username = ?", c.Param("username")).First(&existing).Error == nil {
+		before = existing
+	}
+
+	protection := AccountProtection{
+		Username:  c.Param("username"),
+		AgeGroup:  form.AgeGroup,
+		Guardian:  form.Guardian,
+		Note:      form.Note,
+		UpdatedBy: c.Get("token").(*Token).ParentUsername,
+		UpdatedAt: time.Now(),
+	}
+	if err := WebData.Save(&protection).Error; err != nil {
+		requestLog(c, LogDb).Errorf("save account protection error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionProtect, "user:"+protection.Username, form.Note, before, protection)
+	return c.JSON(http.StatusOK, protection)
+}
+
+func removeAccountProtection(c echo.Context) error {
+	err := WebData.Where("username = ?", c.Param("username")).Delete(&AccountProtection{}).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("delete account protection error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionUnprotect, "user:"+c.Param("username"), "", nil, nil)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// exportBlockedOrders writes the order attempts rejected by the rules as csv, optionally filtered by rule and time
+func exportBlockedOrders(c echo.Context) error {
+	var query BlockedOrderExportRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogDb).Warnf("bind query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil {
+		requestLog(c, LogDb).Warnf("validate query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	db := WebData.Order("created_at ASC")
+	if query.Rule != "" {
+		db = db.Where("rule = ?", query.Rule)
+	}
+	for _, bound := range []struct {
+		date      string
+		condition string
+	}{
+		{query.From, "created_at >= ?"},
+		{query.To, "created_at < ?"},
+	} {
+		if bound.date == "" {
+			continue
+		}
+		t, err := time.ParseInLocation("2006-01-02", bound.date, Timezone)
+		if err != nil {
+			return DefaultBadRequestResponse
+		}
+		db = db.Where(bound.condition, t)
+	}
+
+	rows, err := db.Model(&BlockedOrder{}).Rows()
+	if err != nil {
+		requestLog(c, LogDb).Errorf("find blocked orders error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	defer rows.Close()
+
+	c.Response().Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="blocked-orders.csv"`)
+	c.Response().WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(c.Response())
+	_ = w.Write([]string{"id", "created_at", "username", "client_ip", "price", "pay_type", "rule", "reason"})
+	for rows.Next() {
+		var blocked BlockedOrder
+		if err := WebData.ScanRows(rows, &blocked); err != nil {
+			requestLog(c, LogDb).Errorf("scan blocked order error: %v", err)
+			break
+		}
+		_ = w.Write([]string{
+			strconv.FormatUint(uint64(blocked.ID), 10),
+			blocked.CreatedAt.Format(time.RFC3339),
+			blocked.Username,
+			blocked.ClientIP,
+			strconv.FormatUint(blocked.Price, 10),
+			blocked.PayType,
+			blocked.Rule,
+			blocked.Reason,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dchest/uniuri"
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"gopkg.in/go-playground/validator.v9"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupOrderFlow serves the order api on the sandbox payment platform, backed by the MySQL databases named by
+// FLOATDREAM_TEST_WEB_DSN and FLOATDREAM_TEST_GAME_DSN. The test is skipped unless both are set.
+// returns the server, the bearer token of a new user and a func closing everything.
+func setupOrderFlow(t *testing.T) (*httptest.Server, string, func()) {
+	webDsn, gameDsn := os.Getenv("FLOATDREAM_TEST_WEB_DSN"), os.Getenv("FLOATDREAM_TEST_GAME_DSN")
+	if webDsn == "" || gameDsn == "" {
+		t.Skip("FLOATDREAM_TEST_WEB_DSN and FLOATDREAM_TEST_GAME_DSN are not set")
+	}
+
+	Logger = newLogger()
+	LogDb = Logger.WithField("component", "database")
+	LogPay = Logger.WithField("component", "payment")
+	LogAuth = Logger.WithField("component", "authorization")
+	LogHTTP = Logger.WithField("component", "http")
+
+	var err error
+	if WebData, err = gorm.Open("mysql", webDsn); err != nil {
+		t.Fatalf("open web database: %v", err)
+	}
+	if GameData, err = gorm.Open("mysql", gameDsn); err != nil {
+		t.Fatalf("open game database: %v", err)
+	}
+	if err = migrateDatabases(); err != nil {
+		t.Fatalf("migrate databases: %v", err)
+	}
+
+	e := echo.New()
+	e.Validator = &Validator{validator: validator.New()}
+	order := e.Group("/api/topup/order", needValidation)
+	order.POST("", placeOrder)
+	order.POST("/:orderId/sandbox/pay", payOrderInSandbox)
+	e.POST("/api/topup/order/callback", storeOrder)
+	server := httptest.NewServer(e)
+
+	var config Config
+	config.XorPay.AppID = "4415"
+	config.XorPay.AppSecret = SandboxAppSecretPrefix + "-order-flow"
+	config.XorPay.NotifyURL = server.URL + "/api/topup/order/callback"
+	config.XorPay.Sandbox = true
+	config.Server.PublicURL = server.URL
+	if err = validateSandbox(&config); err != nil {
+		t.Fatalf("validate sandbox config: %v", err)
+	}
+	if err = initComponents(&config); err != nil {
+		t.Fatalf("init components: %v", err)
+	}
+
+	token := Token{
+		Token:          uniuri.NewLen(32),
+		ExpireAt:       time.Now().Add(TokenLifetime),
+		ParentUsername: "flow" + strings.ToLower(uniuri.NewLen(8)),
+	}
+	if err = WebData.Create(&token).Error; err != nil {
+		t.Fatalf("create token: %v", err)
+	}
+
+	return server, token.Token, func() {
+		server.Close()
+		PaySandbox.Close()
+		WebData.Close()
+		GameData.Close()
+	}
+}
+
+func post(t *testing.T, url string, token string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("post %s: %v", url, err)
+	}
+	return resp
+}
+
+func TestOrderFlowInSandbox(t *testing.T) {
+	server, token, closeAll := setupOrderFlow(t)
+	defer closeAll()
+
+	// place the order, which is created on the sandbox platform
+	resp := post(t, server.URL+"/api/topup/order", token, `{"price":"100","payment":"native"}`)
+	var placed PlaceOrderResponse
+	err := json.NewDecoder(resp.Body).Decode(&placed)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("place order: status %d, %v", resp.StatusCode, err)
+	}
+	if placed.QRContent == "" {
+		t.Fatalf("no qr content for order %s", placed.OrderID)
+	}
+
+	// pay it, the sandbox notifies storeOrder which settles and delivers the order before answering
+	resp = post(t, fmt.Sprintf("%s/api/topup/order/%s/sandbox/pay", server.URL, placed.OrderID), token, "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("sandbox pay: status %d", resp.StatusCode)
+	}
+
+	var order Order
+	if err = WebData.Where("order_id = ?", placed.OrderID).First(&order).Error; err != nil {
+		t.Fatalf("find order: %v", err)
+	}
+	if order.Status != OrderStatusDelivered || order.TransactionID == "" || order.PlatformOrderID == order.OrderID {
+		t.Fatalf("order not delivered: %+v", order)
+	}
+	var stored PaidOrder
+	if err = GameData.Where("order_id = ?", placed.OrderID).First(&stored).Error; err != nil {
+		t.Fatalf("find delivered order: %v", err)
+	}
+	if stored.Coins != 100 || stored.Username != order.ParentUsername {
+		t.Fatalf("unexpected delivered order %+v", stored)
+	}
+
+	// the platform retries the same notification, which is acknowledged without delivering again
+	if err = PaySandbox.Notify(order.PlatformOrderID); err != nil {
+		t.Fatalf("resend notification: %v", err)
+	}
+	var notifications []PaymentNotification
+	if err = WebData.Where("order_id = ?", placed.OrderID).Order("id").Find(&notifications).Error; err != nil {
+		t.Fatalf("find notifications: %v", err)
+	}
+	if len(notifications) != 2 || notifications[0].Result != NotificationResultAccepted ||
+		notifications[1].Result != NotificationResultDuplicate {
+		t.Fatalf("unexpected notifications %+v", notifications)
+	}
+	var delivered int
+	GameData.Model(&PaidOrder{}).Where("order_id = ?", placed.OrderID).Count(&delivered)
+	if delivered != 1 {
+		t.Fatalf("order delivered %d times", delivered)
+	}
+}
+
+func TestSandboxRefusedWithRealPlatform(t *testing.T) {
+	var config Config
+	config.XorPay.Sandbox = true
+	config.XorPay.AppSecret = SandboxAppSecretPrefix + "-secret"
+	config.XorPay.BaseURL = "https://xorpay.com"
+	if validateSandbox(&config) == nil {
+		t.Fatalf("sandbox accepted along with baseUrl")
+	}
+
+	config.XorPay.BaseURL = ""
+	config.XorPay.AppSecret = "0123456789abcdef0123456789abcdef"
+	if validateSandbox(&config) == nil {
+		t.Fatalf("sandbox accepted along with a real app secret")
+	}
+
+	config.XorPay.AppSecret = SandboxAppSecretPrefix + "-secret"
+	if err := validateSandbox(&config); err != nil {
+		t.Fatalf("sandbox refused: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+const (
+	OrderStatusCreated   = "created"
+	OrderStatusPaid      = "paid"
+	OrderStatusHeld      = "held"
+	OrderStatusDelivered = "delivered"
+	OrderStatusRefunding = "refunding"
+	OrderStatusRefunded  = "refunded"
+	OrderStatusCancelled = "cancelled"
+
+	// OrderPaymentLifetime is how long a created order could be paid, until its qr code or cashier page expires
+	OrderPaymentLifetime = time.Hour * 2
+)
+
+var (
+	ErrOrderStateConflict    = errors.New("order is not in the expected state")
+	ErrPlatformOrderMismatch = errors.New("order belongs to another platform order")
+
+	// orderTransitions lists the states an order is allowed to move to from each state
+	orderTransitions = map[string][]string{
+		OrderStatusCreated:   {OrderStatusPaid, OrderStatusCancelled},
+		OrderStatusPaid:      {OrderStatusHeld, OrderStatusDelivered, OrderStatusRefunding},
+		OrderStatusHeld:      {OrderStatusDelivered, OrderStatusRefunding},
+		OrderStatusDelivered: {OrderStatusRefunding},
+		OrderStatusRefunding: {OrderStatusRefunded, OrderStatusPaid, OrderStatusHeld, OrderStatusDelivered},
+	}
+)
+
+func canTransitOrder(from string, to string) bool {
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitOrder moves order from its current status to status `to` and updates fields alongside.
+// The update is conditional on the status read before, so that only one of concurrent transitions succeeds;
+// the others get ErrOrderStateConflict.
+func transitOrder(db *gorm.DB, order *Order, to string, fields map[string]interface{}) error {
+	if !canTransitOrder(order.Status, to) {
+		return ErrOrderStateConflict
+	}
+
+	updates := map[string]interface{}{"status": to}
+	for k, v := range fields {
+		updates[k] = v
+	}
+
+	result := db.Model(&Order{}).
+		Where("order_id = ? AND status = ?", order.OrderID, order.Status).
+		Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrOrderStateConflict
+	}
+
+	order.Status = to
+	return nil
+}
+
+// awaitsPlatformOrderID tells if the aoid of the order is still unknown, which is the case for cashier payments
+func (o *Order) awaitsPlatformOrderID() bool {
+	return o.PlatformOrderID == o.OrderID
+}
+
+// settledBy tells if the order has been paid with the transaction transactionId, and has not been refunded since
+func (o *Order) settledBy(transactionId string) bool {
+	switch o.Status {
+	case OrderStatusPaid, OrderStatusHeld, OrderStatusDelivered:
+		return o.TransactionID != "" && o.TransactionID == transactionId
+	default:
+		return false
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	PromotionTypeFirstPurchase = "first_purchase"
+	PromotionTypeTiered        = "tiered"
+	PromotionTypeMultiplier    = "multiplier"
+)
+
+// PromotionTier describes a bonus which is granted once the order price reaches MinPrice
+type PromotionTier struct {
+	MinPrice uint64 `yaml:"minPrice"`
+	Bonus    uint64 `yaml:"bonus"`
+}
+
+// Promotion describes a promotion configured in the config file.
+// Only one promotion applies to an order: the one granting the most bonus coins.
+type Promotion struct {
+	ID         string          `yaml:"id"`
+	Name       string          `yaml:"name"`
+	Type       string          `yaml:"type"`
+	StartAt    *time.Time      `yaml:"startAt"`
+	EndAt      *time.Time      `yaml:"endAt"`
+	Bonus      uint64          `yaml:"bonus"`
+	Multiplier float64         `yaml:"multiplier"`
+	Tiers      []PromotionTier `yaml:"tiers"`
+}
+
+// AppliedPromotion describes the outcome of the promotion evaluation of an order
+type AppliedPromotion struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Bonus uint64 `json:"bonus"`
+}
+
+func (p *Promotion) active(at time.Time) bool {
+	if p.StartAt != nil && at.Before(*p.StartAt) {
+		return false
+	}
+	if p.EndAt != nil && !at.Before(*p.EndAt) {
+		return false
+	}
+	return true
+}
+
+// bonus calculates the bonus coins granted by this promotion for an order with price.
+// firstPurchase tells if the user has never paid any order before.
+func (p *Promotion) bonus(price uint64, firstPurchase bool) uint64 {
+	switch p.Type {
+	case PromotionTypeFirstPurchase:
+		if firstPurchase {
+			return p.Bonus
+		}
+	case PromotionTypeTiered:
+		var bonus uint64
+		for _, tier := range p.Tiers {
+			if price >= tier.MinPrice && tier.Bonus > bonus {
+				bonus = tier.Bonus
+			}
+		}
+		return bonus
+	case PromotionTypeMultiplier:
+		if p.Multiplier > 1 {
+			return uint64(float64(price) * (p.Multiplier - 1))
+		}
+	}
+	return 0
+}
+
+// evaluatePromotions picks the promotion which grants the most bonus coins to an order of price placed by username.
+// returns nil if no promotion applies.
+func evaluatePromotions(promotions []Promotion, username string, price uint64, at time.Time) (*AppliedPromotion, error) {
+	var paidOrders int
+	err := WebData.Model(&Order{}).
+		Where("parent_username = ? AND paid_at IS NOT NULL", username).
+		Count(&paidOrders).Error
+	if err != nil {
+		return nil, err
+	}
+	return bestPromotion(promotions, price, paidOrders == 0, at), nil
+}
+
+// bestPromotion picks among promotions the one active at the time which grants the most bonus coins to an order of price,
+// the first one listed among equal bonuses. returns nil if no promotion grants any bonus.
+func bestPromotion(promotions []Promotion, price uint64, firstPurchase bool, at time.Time) *AppliedPromotion {
+	var applied *AppliedPromotion
+	for i := range promotions {
+		promotion := &promotions[i]
+		if !promotion.active(at) {
+			continue
+		}
+		bonus := promotion.bonus(price, firstPurchase)
+		if bonus == 0 {
+			continue
+		}
+		if applied == nil || bonus > applied.Bonus {
+			applied = &AppliedPromotion{
+				ID:    promotion.ID,
+				Name:  promotion.Name,
+				Type:  promotion.Type,
+				Bonus: bonus,
+			}
+		}
+	}
+	return applied
+}
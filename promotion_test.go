@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPromotionBonus(t *testing.T) {
+	tiered := Promotion{Type: PromotionTypeTiered, Tiers: []PromotionTier{
+		{MinPrice: 5000, Bonus: 500},
+		{MinPrice: 1000, Bonus: 50},
+		{MinPrice: 3000, Bonus: 200},
+	}}
+	tests := []struct {
+		name          string
+		promotion     Promotion
+		price         uint64
+		firstPurchase bool
+		want          uint64
+	}{
+		{"first purchase", Promotion{Type: PromotionTypeFirstPurchase, Bonus: 100}, 600, true, 100},
+		{"not first purchase", Promotion{Type: PromotionTypeFirstPurchase, Bonus: 100}, 600, false, 0},
+		{"below every tier", tiered, 999, false, 0},
+		{"lowest tier", tiered, 1000, false, 50},
+		{"highest tier reached, listed first", tiered, 8000, false, 500},
+		{"tier between", tiered, 4999, false, 200},
+		{"multiplier", Promotion{Type: PromotionTypeMultiplier, Multiplier: 1.5}, 1000, false, 500},
+		{"multiplier not above 1", Promotion{Type: PromotionTypeMultiplier, Multiplier: 0.5}, 1000, false, 0},
+		{"unknown type", Promotion{Type: "lottery", Bonus: 100}, 1000, true, 0},
+	}
+	for _, test := range tests {
+		if got := test.promotion.bonus(test.price, test.firstPurchase); got != test.want {
+			t.Errorf("%s: bonus(%d, %v) = %d, want %d", test.name, test.price, test.firstPurchase, got, test.want)
+		}
+	}
+}
+
+func TestBestPromotion(t *testing.T) {
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	yesterday, tomorrow := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+
+	newcomer := Promotion{ID: "newcomer", Type: PromotionTypeFirstPurchase, Bonus: 300}
+	tiered := Promotion{ID: "tiered", Type: PromotionTypeTiered, Tiers: []PromotionTier{
+		{MinPrice: 1000, Bonus: 100},
+		{MinPrice: 5000, Bonus: 800},
+	}}
+	double := Promotion{ID: "double", Type: PromotionTypeMultiplier, Multiplier: 2}
+	ended := Promotion{ID: "ended", Type: PromotionTypeFirstPurchase, Bonus: 10000, EndAt: &now}
+	upcoming := Promotion{ID: "upcoming", Type: PromotionTypeFirstPurchase, Bonus: 10000, StartAt: &tomorrow}
+	running := Promotion{ID: "running", Type: PromotionTypeFirstPurchase, Bonus: 100, StartAt: &yesterday, EndAt: &tomorrow}
+
+	tests := []struct {
+		name          string
+		promotions    []Promotion
+		price         uint64
+		firstPurchase bool
+		want          string
+		bonus         uint64
+	}{
+		{"none configured", nil, 1000, true, "", 0},
+		{"none granting a bonus", []Promotion{newcomer, tiered}, 500, false, "", 0},
+		{"first purchase wins", []Promotion{tiered, newcomer}, 1000, true, "newcomer", 300},
+		{"tier wins", []Promotion{newcomer, tiered}, 5000, true, "tiered", 800},
+		{"multiplier wins", []Promotion{newcomer, tiered, double}, 3000, true, "double", 3000},
+		{"only the first purchase excluded", []Promotion{newcomer, tiered}, 1000, false, "tiered", 100},
+		{"first listed among equals", []Promotion{running, tiered}, 1000, true, "running", 100},
+		{"ended at the time", []Promotion{ended, running}, 1000, true, "running", 100},
+		{"not started yet", []Promotion{upcoming, running}, 1000, true, "running", 100},
+	}
+	for _, test := range tests {
+		applied := bestPromotion(test.promotions, test.price, test.firstPurchase, now)
+		if test.want == "" {
+			if applied != nil {
+				t.Errorf("%s: applied %+v, want none", test.name, *applied)
+			}
+			continue
+		}
+		if applied == nil {
+			t.Errorf("%s: applied none, want %s", test.name, test.want)
+			continue
+		}
+		if applied.ID != test.want || applied.Bonus != test.bonus {
+			t.Errorf("%s: applied %s with %d bonus, want %s with %d", test.name, applied.ID, applied.Bonus, test.want, test.bonus)
+		}
+	}
+}
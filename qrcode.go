@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"github.com/labstack/echo"
+	"github.com/skip2/go-qrcode"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	// registers the decoders of the logo formats
+	_ "image/gif"
+	_ "image/jpeg"
+)
+
+const (
+	ErrorMessageQRNotAvailable = "该订单没有可用的支付二维码"
+
+	QRFormatPNG = "png"
+	QRFormatSVG = "svg"
+
+	DefaultQRSize = 256
+	// QRCacheLifetime matches the lifetime of the payment qr codes issued by the platform
+	QRCacheLifetime = time.Hour * 2
+	// QRCacheCapacity bounds the rendered images cached, the least recently used ones are evicted first
+	QRCacheCapacity = 1024
+	// QRLogoRatio is the maximum width of the logo relative to the qr code, which the error correction could recover
+	QRLogoRatio = 5
+)
+
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// QRCodeRequest selects the size of the qr code among a few ones, so that the cache is not flooded with every size
+type QRCodeRequest struct {
+	Size int `query:"size" validate:"omitempty,oneof=128 256 512 1024"`
+}
+
+// QRRenderer renders the payment qr codes of orders, and caches the rendered images per order.
+// The cache holds QRCacheCapacity images at most, each for QRCacheLifetime.
+type QRRenderer struct {
+	Size  int
+	Level qrcode.RecoveryLevel
+	Logo  image.Image
+
+	mu    sync.Mutex
+	cache map[string]*list.Element
+	// recent orders the cached entries from the most recently used to the least
+	recent *list.List
+}
+
+type qrCacheEntry struct {
+	key      string
+	data     []byte
+	expireAt time.Time
+}
+
+// NewQRRenderer creates a renderer drawing qr codes of size pixels by default, with the error correction level
+// (one of L, M, Q and H) and an optional logo image file put in the middle.
+func NewQRRenderer(size int, level string, logoFile string) (*QRRenderer, error) {
+	r := &QRRenderer{
+		Size:   size,
+		Level:  qrcode.Medium,
+		cache:  map[string]*list.Element{},
+		recent: list.New(),
+	}
+	if r.Size == 0 {
+		r.Size = DefaultQRSize
+	}
+	if level != "" {
+		l, ok := qrRecoveryLevels[strings.ToUpper(level)]
+		if !ok {
+			return nil, fmt.Errorf("unknown qr error correction level %s", level)
+		}
+		r.Level = l
+	}
+
+	if logoFile != "" {
+		file, err := os.Open(logoFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if r.Logo, _, err = image.Decode(file); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Render returns the qr code of content in format, served from the cache for the same order if rendered before
+func (r *QRRenderer) Render(orderId string, content string, format string, size int) ([]byte, error) {
+	if size == 0 {
+		size = r.Size
+	}
+	key := fmt.Sprintf("%s/%s/%d", orderId, format, size)
+
+	if data, ok := r.cached(key); ok {
+		return data, nil
+	}
+
+	code, err := qrcode.New(content, r.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	if format == QRFormatSVG {
+		data = r.renderSVG(code, size)
+	} else {
+		data, err = r.renderPNG(code, size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.store(key, data)
+	return data, nil
+}
+
+// cached returns the image cached for key unless expired, marking it the most recently used
+func (r *QRRenderer) cached(key string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	element, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*qrCacheEntry)
+	if !entry.expireAt.After(time.Now()) {
+		r.recent.Remove(element)
+		delete(r.cache, key)
+		return nil, false
+	}
+	r.recent.MoveToFront(element)
+	return entry.data, true
+}
+
+// store caches data for key, evicting the least recently used images beyond QRCacheCapacity
+func (r *QRRenderer) store(key string, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry := &qrCacheEntry{
+		key:      key,
+		data:     data,
+		expireAt: time.Now().Add(QRCacheLifetime),
+	}
+	if element, ok := r.cache[key]; ok {
+		element.Value = entry
+		r.recent.MoveToFront(element)
+		return
+	}
+	r.cache[key] = r.recent.PushFront(entry)
+	for r.recent.Len() > QRCacheCapacity {
+		oldest := r.recent.Back()
+		r.recent.Remove(oldest)
+		delete(r.cache, oldest.Value.(*qrCacheEntry).key)
+	}
+}
+
+func (r *QRRenderer) renderPNG(code *qrcode.QRCode, size int) ([]byte, error) {
+	img := code.Image(size)
+	if r.Logo != nil {
+		canvas := image.NewRGBA(img.Bounds())
+		draw.Draw(canvas, canvas.Bounds(), img, image.ZP, draw.Src)
+
+		// the image drawn could be larger than asked, when too small for all the modules
+		bounds := img.Bounds()
+		logo := r.Logo.Bounds()
+		width := logo.Dx()
+		height := logo.Dy()
+		if maxWidth := bounds.Dx() / QRLogoRatio; width > maxWidth {
+			height = height * maxWidth / width
+			width = maxWidth
+		}
+		offset := bounds.Min.Add(image.Pt((bounds.Dx()-width)/2, (bounds.Dy()-height)/2))
+		draw.Draw(canvas, image.Rectangle{Min: offset, Max: offset.Add(image.Pt(width, height))},
+			scaleImage(r.Logo, width, height), image.ZP, draw.Over)
+		img = canvas
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderSVG draws every dark module as a rect. The logo is left out as svg is meant to be scaled freely.
+func (r *QRRenderer) renderSVG(code *qrcode.QRCode, size int) []byte {
+	bitmap := code.Bitmap()
+	modules := len(bitmap)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		size, size, modules, modules)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(&buf, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// scaleImage resizes src to width x height with nearest neighbour sampling, which is enough for a small logo
+func scaleImage(src image.Image, width int, height int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dst.Set(x, y, src.At(bounds.Min.X+x*bounds.Dx()/width, bounds.Min.Y+y*bounds.Dy()/height))
+		}
+	}
+	return dst
+}
+
+func renderOrderQRCode(format string, contentType string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var query QRCodeRequest
+		if err := c.Bind(&query); err != nil {
+			requestLog(c, LogPay).Warnf("bind query error: %v", err)
+			return DefaultBadRequestResponse
+		}
+		if err := c.Validate(&query); err != nil {
+			requestLog(c, LogPay).Warnf("validate query error: %v", err)
+			return DefaultBadRequestResponse
+		}
+
+		var order Order
+		err := WebData.Where(&Order{
+			OrderID:        c.Param("orderId"),
+			ParentUsername: c.Get("token").(*Token).ParentUsername,
+		}).First(&order).Error
+		if err != nil {
+			requestLog(c, LogDb).Errorf("query order error: %v", err)
+			return NewErrorResponse(http.StatusNotFound, ErrorMessageOrderNotFound)
+		}
+		if order.QRContent == "" || order.Status != OrderStatusCreated {
+			return NewErrorResponse(http.StatusNotFound, ErrorMessageQRNotAvailable)
+		}
+
+		data, err := QRCodeRenderer.Render(order.OrderID, order.QRContent, format, query.Size)
+		if err != nil {
+			requestLog(c, LogPay).Errorf("render qr code of order %s error: %v", order.OrderID, err)
+			return NewErrorResponse(http.StatusInternalServerError, ErrorMessageServerError)
+		}
+
+		c.Response().Header().Set("Cache-Control", "private, max-age=600")
+		return c.Blob(http.StatusOK, contentType, data)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestQRCacheEviction(t *testing.T) {
+	r, err := NewQRRenderer(0, "", "")
+	if err != nil {
+		t.Fatalf("create renderer error: %v", err)
+	}
+	for i := 0; i < QRCacheCapacity; i++ {
+		r.store(fmt.Sprintf("order-%d", i), []byte{byte(i)})
+	}
+	// order-0 becomes the most recently used, leaving order-1 the least
+	if _, ok := r.cached("order-0"); !ok {
+		t.Fatalf("order-0 is not cached")
+	}
+	r.store("order-new", []byte("new"))
+
+	if len(r.cache) != QRCacheCapacity || r.recent.Len() != QRCacheCapacity {
+		t.Errorf("cache holds %d entries listed %d times, want %d", len(r.cache), r.recent.Len(), QRCacheCapacity)
+	}
+	if _, ok := r.cached("order-1"); ok {
+		t.Errorf("least recently used order-1 is not evicted")
+	}
+	for _, key := range []string{"order-0", "order-2", "order-new", fmt.Sprintf("order-%d", QRCacheCapacity-1)} {
+		if _, ok := r.cached(key); !ok {
+			t.Errorf("%s is evicted", key)
+		}
+	}
+
+	// storing a cached key again replaces it without evicting anything
+	r.store("order-2", []byte("again"))
+	if data, _ := r.cached("order-2"); string(data) != "again" {
+		t.Errorf("order-2 cached as %q, want %q", data, "again")
+	}
+	if _, ok := r.cached("order-3"); !ok || len(r.cache) != QRCacheCapacity {
+		t.Errorf("storing order-2 again evicted an entry")
+	}
+}
+
+func TestQRCacheExpiry(t *testing.T) {
+	r, err := NewQRRenderer(0, "", "")
+	if err != nil {
+		t.Fatalf("create renderer error: %v", err)
+	}
+	r.store("expired", []byte("expired"))
+	r.store("fresh", []byte("fresh"))
+	r.cache["expired"].Value.(*qrCacheEntry).expireAt = time.Now().Add(-time.Second)
+
+	if _, ok := r.cached("expired"); ok {
+		t.Errorf("expired entry is served")
+	}
+	if _, ok := r.cache["expired"]; ok || r.recent.Len() != 1 {
+		t.Errorf("expired entry is kept in the cache")
+	}
+	if data, ok := r.cached("fresh"); !ok || string(data) != "fresh" {
+		t.Errorf("fresh entry cached as %q, want %q", data, "fresh")
+	}
+}
+
+func TestQRRender(t *testing.T) {
+	r, err := NewQRRenderer(0, "h", "")
+	if err != nil {
+		t.Fatalf("create renderer error: %v", err)
+	}
+	data, err := r.Render("order", "weixin://wxpay/bizpayurl?pr=abc", QRFormatPNG, 0)
+	if err != nil {
+		t.Fatalf("render error: %v", err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode rendered png error: %v", err)
+	}
+	if size := img.Bounds().Dx(); size != DefaultQRSize {
+		t.Errorf("rendered %d pixels wide, want %d", size, DefaultQRSize)
+	}
+
+	svg, err := r.Render("order", "weixin://wxpay/bizpayurl?pr=abc", QRFormatSVG, 512)
+	if err != nil {
+		t.Fatalf("render svg error: %v", err)
+	}
+	if !bytes.HasPrefix(svg, []byte(`<svg`)) || !bytes.Contains(svg, []byte(`width="512"`)) {
+		t.Errorf("rendered svg %.80s is not 512 wide", svg)
+	}
+	if len(r.cache) != 2 {
+		t.Errorf("cache holds %d entries, want one per format and size", len(r.cache))
+	}
+
+	if _, err = NewQRRenderer(0, "X", ""); err == nil {
+		t.Errorf("unknown error correction level accepted")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/labstack/echo"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DiscrepancyMissedPayment   = "missed_payment"
+	DiscrepancyAmountMismatch  = "amount_mismatch"
+	DiscrepancyUnknownUpstream = "unknown_upstream"
+	DiscrepancyPendingRefund   = "pending_refund"
+
+	DefaultReconcileWindow = time.Hour * 48
+)
+
+// ReconcileDiscrepancy describes an order whose local state does not match the payment platform
+type ReconcileDiscrepancy struct {
+	Kind            string `json:"kind"`
+	OrderID         string `json:"order_id"`
+	PlatformOrderID string `json:"platform_order_id"`
+	LocalPrice      uint64 `json:"local_price"`
+	UpstreamStatus  string `json:"upstream_status"`
+	UpstreamPrice   string `json:"upstream_price"`
+	Repaired        bool   `json:"repaired"`
+	Error           string `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	StartedAt     time.Time              `json:"started_at"`
+	FinishedAt    time.Time              `json:"finished_at"`
+	Since         time.Time              `json:"since"`
+	Checked       int                    `json:"checked"`
+	Failed        int                    `json:"failed"`
+	Discrepancies []ReconcileDiscrepancy `json:"discrepancies"`
+}
+
+type ReconcileRequest struct {
+	Hours uint `query:"hours" validate:"omitempty,min=1,max=720"`
+}
+
+func priceMatches(local uint64, upstream string) bool {
+	price, err := strconv.ParseFloat(upstream, 64)
+	if err != nil {
+		return false
+	}
+	return math.Abs(price-float64(local)) < 0.005
+}
+
+// queryUpstream queries the platform for order, by its order id while its aoid is not known
+func queryUpstream(ctx context.Context, order *Order) (*xorpay.PlatformQueryResponse, error) {
+	if order.awaitsPlatformOrderID() {
+		return PaySession.QueryOrder(ctx, order.OrderID)
+	}
+	return PaySession.Query(ctx, order.PlatformOrderID)
+}
+
+// reconcileOrders queries the platform for every unpaid order created after since,
+// and settles the orders which have been paid upstream but whose notifications were lost.
+// The amounts of the orders paid after since are checked against the platform, and
+// the refunds left unknown are resolved as well, whenever they were requested.
+func reconcileOrders(ctx context.Context, since time.Time) (*ReconcileReport, error) {
+	report := ReconcileReport{
+		StartedAt:     time.Now(),
+		Since:         since,
+		Discrepancies: []ReconcileDiscrepancy{},
+	}
+
+	var orders []Order
+	err := WebData.Where("status = ? AND created_at >= ?", OrderStatusCreated, since).Find(&orders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range orders {
+		order := &orders[i]
+		report.Checked++
+
+		upstream, err := queryUpstream(ctx, order)
+		if err != nil {
+			LogPay.Errorf("query platform order of %s error: %v", order.OrderID, err)
+			report.Failed++
+			continue
+		}
+
+		discrepancy := ReconcileDiscrepancy{
+			OrderID:         order.OrderID,
+			PlatformOrderID: order.PlatformOrderID,
+			LocalPrice:      order.PaidPrice,
+			UpstreamStatus:  upstream.Status,
+			UpstreamPrice:   upstream.PayPrice,
+		}
+		if order.awaitsPlatformOrderID() {
+			discrepancy.PlatformOrderID = upstream.PlatformOrderID
+		}
+
+		switch {
+		case upstream.Status == xorpay.QueryStatusNotExist:
+			if order.awaitsPlatformOrderID() {
+				// the cashier page has never been opened
+				continue
+			}
+			discrepancy.Kind = DiscrepancyUnknownUpstream
+		case !upstream.Paid():
+			continue
+		case !priceMatches(order.PaidPrice, upstream.PayPrice):
+			// paid, but not what we asked for. leave it to be inspected by hand
+			discrepancy.Kind = DiscrepancyAmountMismatch
+		case discrepancy.PlatformOrderID == "":
+			discrepancy.Kind = DiscrepancyMissedPayment
+			discrepancy.Error = "the platform did not tell the aoid"
+		default:
+			discrepancy.Kind = DiscrepancyMissedPayment
+
+			paidAt, err := time.ParseInLocation("2006-01-02 15:04:05", upstream.PayTime, xorpay.Location)
+			if err != nil {
+				paidAt = time.Now()
+			}
+			_, err = settleOrder(order.OrderID, discrepancy.PlatformOrderID, paidAt, xorpay.PlatformNotifyResponseDetail{})
+			if err != nil {
+				discrepancy.Error = err.Error()
+			} else {
+				discrepancy.Repaired = true
+			}
+		}
+
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+	}
+
+	// the notifications are accepted whatever they paid, so compare the paid orders with what the platform received
+	var paid []Order
+	err = WebData.Where("status IN (?) AND paid_at >= ?", countedOrderStatuses, since).Find(&paid).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range paid {
+		order := &paid[i]
+		report.Checked++
+
+		upstream, err := queryUpstream(ctx, order)
+		if err != nil {
+			LogPay.Errorf("query platform order of %s error: %v", order.OrderID, err)
+			report.Failed++
+			continue
+		}
+
+		discrepancy := ReconcileDiscrepancy{
+			OrderID:         order.OrderID,
+			PlatformOrderID: order.PlatformOrderID,
+			LocalPrice:      order.PaidPrice,
+			UpstreamStatus:  upstream.Status,
+			UpstreamPrice:   upstream.PayPrice,
+		}
+		switch {
+		case upstream.Status == xorpay.QueryStatusNotExist:
+			discrepancy.Kind = DiscrepancyUnknownUpstream
+		case upstream.Paid() && !priceMatches(order.PaidPrice, upstream.PayPrice):
+			discrepancy.Kind = DiscrepancyAmountMismatch
+		default:
+			continue
+		}
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+	}
+
+	// resolve the refunds whose outcome was unknown
+	var refunding []Order
+	err = WebData.Where("status = ? AND refund_price > 0", OrderStatusRefunding).Find(&refunding).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range refunding {
+		order := &refunding[i]
+		report.Checked++
+		discrepancy := ReconcileDiscrepancy{
+			Kind:            DiscrepancyPendingRefund,
+			OrderID:         order.OrderID,
+			PlatformOrderID: order.PlatformOrderID,
+			LocalPrice:      order.RefundPrice,
+		}
+		repaired, err := resolveRefund(ctx, order)
+		if err != nil {
+			LogPay.Errorf("resolve refund of order %s error: %v", order.OrderID, err)
+			discrepancy.Error = err.Error()
+		}
+		discrepancy.Repaired = repaired
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+	}
+
+	report.FinishedAt = time.Now()
+	return &report, nil
+}
+
+func (r *ReconcileReport) String() string {
+	return fmt.Sprintf("checked %d orders since %s: %d discrepancies, %d queries failed",
+		r.Checked, r.Since.Format(time.RFC3339), len(r.Discrepancies), r.Failed)
+}
+
+// startReconcileJob reconciles the orders created within window every interval in the background, until the shutdown
+func startReconcileJob(lifecycle *Lifecycle, interval time.Duration, window time.Duration) {
+	lifecycle.Go(func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			report, err := reconcileOrders(ctx, time.Now().Add(-window))
+			if err != nil {
+				LogPay.Errorf("reconcile orders error: %v", err)
+				continue
+			}
+			LogPay.Infof("reconciliation finished: %s", report)
+			for _, d := range report.Discrepancies {
+				LogPay.Warnf("reconciliation discrepancy: %+v", d)
+			}
+		}
+	})
+}
+
+func reconcileOrdersNow(c echo.Context) error {
+	var query ReconcileRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogPay).Warnf("bind query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil {
+		requestLog(c, LogPay).Warnf("validate query error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	window := DefaultReconcileWindow
+	if query.Hours != 0 {
+		window = time.Duration(query.Hours) * time.Hour
+	}
+
+	report, err := reconcileOrders(c.Request().Context(), time.Now().Add(-window))
+	if err != nil {
+		requestLog(c, LogPay).Errorf("reconcile orders error: %v", err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"net/http"
+	"time"
+)
+
+const (
+	ErrorMessageOrderNotFound      = "未找到订单"
+	ErrorMessageOrderNotRefundable = "订单当前状态无法退款"
+	ErrorMessageRefundPriceError   = "退款金额超出订单实付金额"
+	ErrorMessageRefundFailed       = "退款发起失败，稍后请重试"
+)
+
+type RefundOrderRequest struct {
+	Price  uint64 `json:"price,string" validate:"omitempty,min=1"`
+	Reason string `json:"reason" validate:"required,max=255"`
+}
+
+func refundOrder(c echo.Context) error {
+	var form RefundOrderRequest
+	if err := c.Bind(&form); err != nil {
+		requestLog(c, LogPay).Warnf("bind form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+	if err := c.Validate(&form); err != nil {
+		requestLog(c, LogPay).Warnf("validate form error: %v", err)
+		return DefaultBadRequestResponse
+	}
+
+	var order Order
+	err := WebData.Where(&Order{
+		OrderID: c.Param("orderId"),
+	}).First(&order).Error
+	if err != nil {
+		requestLog(c, LogDb).Errorf("query order error: %v", err)
+		return NewErrorResponse(http.StatusNotFound, ErrorMessageOrderNotFound)
+	}
+
+	// refunds the whole paid price if not specified
+	if form.Price == 0 {
+		form.Price = order.PaidPrice
+	}
+	if form.Price > order.PaidPrice {
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageRefundPriceError)
+	}
+
+	before := newAdminOrder(order)
+
+	// lock the order in refunding state, so that it could only be refunded once
+	previousStatus := order.Status
+	if err = transitOrder(WebData, &order, OrderStatusRefunding, nil); err != nil {
+		requestLog(c, LogPay).Errorf("refund order %s in status %s error: %v", order.OrderID, previousStatus, err)
+		return NewErrorResponse(http.StatusConflict, ErrorMessageOrderNotRefundable)
+	}
+
+	if err = PaySession.Refund(c.Request().Context(), order.PlatformOrderID, form.Price); err != nil {
+		requestLog(c, LogPay).Errorf("platform refund order %s error: %v", order.OrderID, err)
+		if refundOutcomeUnknown(err) {
+			// the money may have been returned, the order stays refunding until resolved by the reconciliation
+			err = WebData.Model(&Order{}).
+				Where("order_id = ? AND status = ?", order.OrderID, OrderStatusRefunding).
+				Updates(map[string]interface{}{
+					"refund_price":  form.Price,
+					"refund_reason": form.Reason,
+				}).Error
+			if err != nil {
+				requestLog(c, LogDb).Errorf("save refunding order %s error: %v", order.OrderID, err)
+			}
+			order.RefundPrice = form.Price
+			order.RefundReason = form.Reason
+			audit(c, AuditActionRefund, "order:"+order.OrderID, form.Reason, before, newAdminOrder(order))
+			return c.JSON(http.StatusAccepted, order)
+		}
+		if err := transitOrder(WebData, &order, previousStatus, nil); err != nil {
+			requestLog(c, LogPay).Errorf("restore order %s to status %s error: %v", order.OrderID, previousStatus, err)
+		}
+		return NewErrorResponse(http.StatusBadGateway, ErrorMessageRefundFailed)
+	}
+
+	if err = completeRefund(&order, form.Price, form.Reason); err != nil {
+		// the money has been returned already, the order has to be fixed by hand
+		requestLog(c, LogPay).Errorf("save refunded order %s error: %v", order.OrderID, err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	audit(c, AuditActionRefund, "order:"+order.OrderID, form.Reason, before, newAdminOrder(order))
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// refundOutcomeUnknown tells if the platform may have refunded despite err, e.g. timed out after receiving the request.
+// The requests refused with a client error, xorpay.ErrRequestRejected, have not been refunded.
+func refundOutcomeUnknown(err error) bool {
+	switch errors.Cause(err) {
+	case xorpay.ErrPlatformUnavailable, xorpay.ErrBadResponse, context.DeadlineExceeded, context.Canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// completeRefund takes back the coins of an order refunded on the platform, proportionally to price, and marks it refunded.
+// The coins are debited from the player only if the order has been delivered; otherwise they have never been credited.
+func completeRefund(order *Order, price uint64, reason string) error {
+	coins := order.Coins()
+	if price != order.PaidPrice {
+		coins = coins * price / order.PaidPrice
+	}
+
+	var shortfall uint64
+	var err error
+	if order.ProcessedAt != nil {
+		shortfall, err = debitCoins(order, coins)
+	} else {
+		shortfall, err = withdrawCoins(order, coins)
+	}
+	if err != nil {
+		LogPay.Errorf("debit coins of refunded order %s error: %v", order.OrderID, err)
+	}
+	if shortfall != 0 {
+		LogPay.Warnf("refunded order %s has %d coins not debited", order.OrderID, shortfall)
+	}
+
+	now := time.Now()
+	err = transitOrder(WebData, order, OrderStatusRefunded, map[string]interface{}{
+		"refund_price":     price,
+		"refund_reason":    reason,
+		"refund_shortfall": shortfall,
+		"refunded_at":      &now,
+	})
+	if err != nil {
+		return err
+	}
+	order.RefundPrice = price
+	order.RefundReason = reason
+	order.RefundShortfall = shortfall
+	order.RefundedAt = &now
+	return nil
+}
+
+// resolveRefund finds out the outcome of a refund of price left unknown, see refundOutcomeUnknown.
+// The refund has gone through if the platform reports the order refunded. While still reported paid,
+// a full refund is sent again, since the platform refuses to refund more than paid: either this one or the one
+// before goes through. A partial refund could be sent twice that way, so it is left to be checked by hand.
+// returns whether the order has been refunded.
+func resolveRefund(ctx context.Context, order *Order) (bool, error) {
+	upstream, err := PaySession.Query(ctx, order.PlatformOrderID)
+	if err != nil {
+		return false, err
+	}
+	if upstream.Refunded() {
+		return true, completeRefund(order, order.RefundPrice, order.RefundReason)
+	}
+	if !upstream.Paid() {
+		return false, fmt.Errorf("platform order in status %s", upstream.Status)
+	}
+	if order.RefundPrice != order.PaidPrice {
+		return false, fmt.Errorf("partial refund of %d to be checked on the platform", order.RefundPrice)
+	}
+
+	err = PaySession.Refund(ctx, order.PlatformOrderID, order.RefundPrice)
+	if err != nil && errors.Cause(err) != xorpay.ErrPriceInvalid {
+		return false, err
+	}
+	return true, completeRefund(order, order.RefundPrice, order.RefundReason)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"gopkg.in/yaml.v2"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// ConfigWatchInterval is how often the config file is checked for changes
+	ConfigWatchInterval = time.Second * 5
+)
+
+var (
+	// reloadableConfigPaths are the parts of the config applied by reloading; changing any other part needs a restart
+	reloadableConfigPaths = []string{
+		"server.publicUrl",
+		"server.orderPageUrl",
+		"server.cors",
+		"log",
+		"limits",
+		"minorGroups",
+		"promotions",
+		"admin.usernames",
+		"game.address",
+	}
+
+	loadedSettings atomic.Value
+)
+
+// Settings are the parts of the config which could be reloaded without restarting. A request reads them once
+// through currentSettings, so that it is served by the same settings throughout even if reloaded meanwhile.
+type Settings struct {
+	// PublicURL is where browsers reach this server, without the trailing slash
+	PublicURL    string
+	OrderPageURL string
+	// CORS is nil when CORS is disabled
+	CORS        echo.MiddlewareFunc
+	Promotions  []Promotion
+	OrderRules  []OrderRule
+	MinorGroups []MinorGroup
+	// AdminUsernames are always granted the superadmin role
+	AdminUsernames map[string]bool
+	// ServerStatus measures the latency of the game server
+	ServerStatus *CachedServerStatus
+}
+
+func NewSettings(config *Config) *Settings {
+	s := Settings{
+		PublicURL:      strings.TrimSuffix(config.Server.PublicURL, "/"),
+		OrderPageURL:   config.Server.OrderPageURL,
+		Promotions:     config.Promotions,
+		OrderRules:     NewOrderRules(config.Limits),
+		MinorGroups:    config.MinorGroups,
+		AdminUsernames: map[string]bool{},
+		ServerStatus:   NewStatusCache(config.Game.Address, ServerStatusUpdateInterval),
+	}
+	if config.Server.CORS.Enabled {
+		s.CORS = middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins: config.Server.CORS.AllowOrigins,
+			AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization},
+		})
+	}
+	if len(s.MinorGroups) != 0 {
+		s.OrderRules = append(s.OrderRules, NewMinorProtectionRule(s.MinorGroups))
+	}
+	for _, username := range config.Admin.Usernames {
+		s.AdminUsernames[username] = true
+	}
+	return &s
+}
+
+func currentSettings() *Settings {
+	return loadedSettings.Load().(*Settings)
+}
+
+// applyCORS applies the CORS settings in effect when the request arrives
+func applyCORS(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if cors := currentSettings().CORS; cors != nil {
+			return cors(next)(c)
+		}
+		return next(c)
+	}
+}
+
+// flattenConfigTree maps the path of every leaf of a yaml tree to its value. Lists are leaves as a whole.
+func flattenConfigTree(prefix string, node interface{}, leaves map[string]interface{}) {
+	if mapping, ok := node.(yaml.MapSlice); ok {
+		for _, item := range mapping {
+			path := fmt.Sprint(item.Key)
+			if prefix != "" {
+				path = prefix + "." + path
+			}
+			flattenConfigTree(path, item.Value, leaves)
+		}
+		return
+	}
+	leaves[prefix] = node
+}
+
+// flattenConfig maps the path of every leaf of config to its value, secrets included
+func flattenConfig(config *Config) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var tree yaml.MapSlice
+	if err = yaml.Unmarshal(data, &tree); err != nil {
+		return nil, err
+	}
+	leaves := map[string]interface{}{}
+	flattenConfigTree("", tree, leaves)
+	return leaves, nil
+}
+
+func formatConfigLeaf(leaf interface{}) string {
+	value, _ := yaml.Marshal(leaf)
+	return strings.TrimSpace(string(value))
+}
+
+// ConfigChange is a leaf of the config changed by a reload. Its values are only redacted when printed,
+// so that the changes of the secrets are detected as well.
+type ConfigChange struct {
+	Path string
+	From interface{}
+	To   interface{}
+}
+
+// redactConfigLeaf formats the value of the leaf at path, without the secrets it is or it contains
+func redactConfigLeaf(path string, leaf interface{}) string {
+	if s, ok := leaf.(string); ok && s != "" && isSensitiveKey(path[strings.LastIndex(path, ".")+1:]) {
+		return RedactedValue
+	}
+	return formatConfigLeaf(redactConfigTree(leaf))
+}
+
+func (c ConfigChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Path, redactConfigLeaf(c.Path, c.From), redactConfigLeaf(c.Path, c.To))
+}
+
+func (c ConfigChange) reloadable() bool {
+	for _, path := range reloadableConfigPaths {
+		if c.Path == path || strings.HasPrefix(c.Path, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfig lists the leaves changed from previous to next, sorted by path
+func diffConfig(previous *Config, next *Config) ([]ConfigChange, error) {
+	from, err := flattenConfig(previous)
+	if err != nil {
+		return nil, err
+	}
+	to, err := flattenConfig(next)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []ConfigChange
+	for path, value := range to {
+		if previous, ok := from[path]; !ok || formatConfigLeaf(previous) != formatConfigLeaf(value) {
+			changes = append(changes, ConfigChange{Path: path, From: from[path], To: value})
+		}
+	}
+	for path, value := range from {
+		if _, ok := to[path]; !ok {
+			changes = append(changes, ConfigChange{Path: path, From: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
+
+// ConfigReloader reloads the config file when it changes or when the process receives SIGHUP
+type ConfigReloader struct {
+	File string
+
+	mu      sync.Mutex
+	config  *Config
+	modTime time.Time
+}
+
+func NewConfigReloader(file string, config *Config) *ConfigReloader {
+	r := ConfigReloader{
+		File:   file,
+		config: config,
+	}
+	if info, err := os.Stat(file); err == nil {
+		r.modTime = info.ModTime()
+	}
+	return &r
+}
+
+// Reload reads and validates the config, then swaps the settings if only the reloadable parts have changed.
+// The running config is kept as is if anything fails.
+func (r *ConfigReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := readConfig(r.File)
+	if err != nil {
+		return err
+	}
+	changes, err := diffConfig(r.config, next)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		LogHTTP.Info("config reloaded, nothing changed")
+		return nil
+	}
+
+	var rejected []string
+	for _, change := range changes {
+		if !change.reloadable() {
+			rejected = append(rejected, change.Path)
+		}
+	}
+	if len(rejected) != 0 {
+		return fmt.Errorf("changes to %s need a restart, nothing reloaded", strings.Join(rejected, ", "))
+	}
+
+	if err := configureLogger(Logger, next.Log); err != nil {
+		return err
+	}
+	settings := NewSettings(next)
+	if next.Game.Address == r.config.Game.Address {
+		// keep measuring the same game server from where it was
+		settings.ServerStatus = currentSettings().ServerStatus
+	}
+	loadedSettings.Store(settings)
+	r.config = next
+	for _, change := range changes {
+		LogHTTP.Infof("config reloaded, %s", change)
+	}
+	return nil
+}
+
+// changed tells if the file has been modified since last checked
+func (r *ConfigReloader) changed() bool {
+	info, err := os.Stat(r.File)
+	if err != nil {
+		return false
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return false
+	}
+	r.modTime = info.ModTime()
+	return true
+}
+
+// Watch reloads the config on SIGHUP and when the file changes, until ctx is done
+func (r *ConfigReloader) Watch(ctx context.Context) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	ticker := time.NewTicker(ConfigWatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+			LogHTTP.Info("received SIGHUP, reloading config")
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			LogHTTP.Infof("%s changed, reloading config", r.File)
+		}
+		if err := r.Reload(); err != nil {
+			LogHTTP.Errorf("reload config error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     func(config *Config)
+		paths      []string
+		reloadable bool
+	}{
+		{"nothing", func(config *Config) {}, nil, true},
+		{"public url", func(config *Config) {
+			config.Server.PublicURL = "https://pay.example"
+		}, []string{"server.publicUrl"}, true},
+		{"cors", func(config *Config) {
+			config.Server.CORS.Enabled = true
+			config.Server.CORS.AllowOrigins = []string{"https://a.example", "https://b.example"}
+		}, []string{"server.cors.allowOrigins", "server.cors.enabled"}, true},
+		{"limits", func(config *Config) {
+			config.Limits.DailyCap = 100000
+			config.Limits.IPVelocity.Window = time.Hour
+		}, []string{"limits.dailyCap", "limits.ipVelocity.window"}, true},
+		{"promotions", func(config *Config) {
+			config.Promotions = append(config.Promotions, Promotion{ID: "spring", Bonus: 100})
+		}, []string{"promotions"}, true},
+		{"admin usernames", func(config *Config) {
+			config.Admin.Usernames = []string{"Steve", "Alex"}
+		}, []string{"admin.usernames"}, true},
+		{"xorpay secret", func(config *Config) {
+			config.XorPay.AppSecret = "rotated-secret"
+		}, []string{"xorpay.appSecret"}, false},
+		{"database", func(config *Config) {
+			config.Database.Web.DSN = "root:hunter2@tcp(db)/web"
+			config.Database.MigrateOnStart = true
+		}, []string{"database.migrateOnStart", "database.web.dsn"}, false},
+		{"server address", func(config *Config) {
+			config.Server.Address = ":9090"
+		}, []string{"server.address"}, false},
+		{"reloadable along with a restart", func(config *Config) {
+			config.Limits.MonthlyCap = 500000
+			config.Stats.CacheTTL = time.Minute
+		}, []string{"limits.monthlyCap", "stats.cacheTTL"}, false},
+	}
+	for _, test := range tests {
+		previous := testReloadConfig()
+		next := testReloadConfig()
+		test.change(next)
+
+		changes, err := diffConfig(previous, next)
+		if err != nil {
+			t.Errorf("%s: diffConfig error: %v", test.name, err)
+			continue
+		}
+		var paths []string
+		reloadable := true
+		for _, change := range changes {
+			paths = append(paths, change.Path)
+			reloadable = reloadable && change.reloadable()
+		}
+		if !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: changed %q, want %q", test.name, paths, test.paths)
+		}
+		if reloadable != test.reloadable {
+			t.Errorf("%s: reloadable = %v, want %v", test.name, reloadable, test.reloadable)
+		}
+	}
+}
+
+func TestConfigChangeReloadable(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"server.publicUrl", true},
+		{"server.cors", true},
+		{"server.cors.allowOrigins", true},
+		{"limits.ipVelocity.maxOrders", true},
+		{"game.address", true},
+		{"server.address", false},
+		{"server.corsOrigins", false},
+		{"game.balance.table", false},
+		{"xorpay.appSecret", false},
+		{"database.web.dsn", false},
+	}
+	for _, test := range tests {
+		if got := (ConfigChange{Path: test.path}).reloadable(); got != test.want {
+			t.Errorf("reloadable(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestConfigChangeString(t *testing.T) {
+	previous := testReloadConfig()
+	next := testReloadConfig()
+	next.XorPay.AppSecret = "rotated-secret"
+	next.Limits.DailyCap = 100000
+
+	changes, err := diffConfig(previous, next)
+	if err != nil {
+		t.Fatalf("diffConfig error: %v", err)
+	}
+	var lines []string
+	for _, change := range changes {
+		lines = append(lines, change.String())
+	}
+	want := []string{
+		"limits.dailyCap: 0 -> 100000",
+		"xorpay.appSecret: " + RedactedValue + " -> " + RedactedValue,
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("changes printed as %q, want %q", lines, want)
+	}
+	if printed := strings.Join(lines, "\n"); strings.Contains(printed, "secret-") || strings.Contains(printed, "rotated") {
+		t.Errorf("changes print the secret:\n%s", printed)
+	}
+}
+
+func testReloadConfig() *Config {
+	var config Config
+	config.Server.Address = ":8080"
+	config.Server.PublicURL = "https://floatdream.example"
+	config.Database.Web.Source = "mysql"
+	config.Database.Web.DSN = "root:secret-web@tcp(localhost)/web"
+	config.Game.Address = "mc.floatdream.example:25565"
+	config.XorPay.AppID = "4415"
+	config.XorPay.AppSecret = "secret-xorpay"
+	config.Promotions = []Promotion{{ID: "launch", Name: "launch", Type: PromotionTypeFirstPurchase, Bonus: 50}}
+	return &config
+}
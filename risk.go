@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+	"time"
+)
+
+const (
+	RiskActionAllow  = "allow"
+	RiskActionHold   = "hold"
+	RiskActionReject = "reject"
+)
+
+// LimitsConfig configures the spending limits and velocity checks of order placement. Zero disables a limit.
+type LimitsConfig struct {
+	DailyCap         uint64 `yaml:"dailyCap"`
+	MonthlyCap       uint64 `yaml:"monthlyCap"`
+	MaxPendingOrders int    `yaml:"maxPendingOrders"`
+	IPVelocity       struct {
+		MaxOrders int           `yaml:"maxOrders"`
+		Window    time.Duration `yaml:"window"`
+	} `yaml:"ipVelocity"`
+	// ReviewAbove holds the orders with a price above it for review before delivery
+	ReviewAbove uint64 `yaml:"reviewAbove"`
+}
+
+// OrderAttempt describes an order about to be placed
+type OrderAttempt struct {
+	Username string
+	ClientIP string
+	Price    uint64
+	PayType  string
+	At       time.Time
+}
+
+// RiskDecision is the outcome of an OrderRule. Reason is shown to the user when rejected.
+type RiskDecision struct {
+	Action string
+	Rule   string
+	Reason string
+}
+
+// OrderRule inspects an order attempt before it is placed.
+// Rules are evaluated in order; the first rejection wins, while holds are collected.
+type OrderRule struct {
+	Name  string
+	Check func(attempt *OrderAttempt) (RiskDecision, error)
+}
+
+// BlockedOrder records an order attempt rejected by an OrderRule
+type BlockedOrder struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	Username  string    `gorm:"size:255;index;NOT NULL" json:"username"`
+	ClientIP  string    `gorm:"size:64" json:"client_ip"`
+	Price     uint64    `gorm:"NOT NULL" json:"price"`
+	PayType   string    `gorm:"size:32" json:"pay_type"`
+	Rule      string    `gorm:"size:64;index" json:"rule"`
+	Reason    string    `gorm:"size:255" json:"reason"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+var (
+	// countedOrderStatuses are the statuses of paid orders which count towards the spending caps, including the
+	// refunding ones which could be restored to paid. Created orders count as well until they could not be paid
+	// anymore, see OrderPaymentLifetime.
+	countedOrderStatuses = []string{OrderStatusPaid, OrderStatusHeld, OrderStatusDelivered, OrderStatusRefunding}
+)
+
+// UserLock is a row per user, locked while placing an order of the user so that the limits are checked
+// and the order is created by one placement at a time
+type UserLock struct {
+	Username string `gorm:"size:255;primary_key" json:"username"`
+}
+
+// lockUser locks the UserLock of username until tx ends, creating it if missing
+func lockUser(tx *gorm.DB, username string) error {
+	if err := tx.Exec("INSERT IGNORE INTO `user_locks` (`username`) VALUES (?)", username).Error; err != nil {
+		return err
+	}
+	var lock UserLock
+	return tx.Set("gorm:query_option", "FOR UPDATE").Where("username = ?", username).First(&lock).Error
+}
+
+// spentSince sums the prices of the orders of username placed after since, paid or still payable
+func spentSince(username string, since time.Time) (uint64, error) {
+	var result struct {
+		Total uint64
+	}
+	err := WebData.Model(&Order{}).
+		Select("COALESCE(SUM(paid_price), 0) AS total").
+		Where("parent_username = ? AND created_at >= ?", username, since).
+		Where("status IN (?) OR (status = ? AND created_at >= ?)",
+			countedOrderStatuses, OrderStatusCreated, time.Now().Add(-OrderPaymentLifetime)).
+		Scan(&result).Error
+	return result.Total, err
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func startOfMonth(t time.Time) time.Time {
+	y, m, _ := t.Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// NewOrderRules builds the rules enforcing limits. More rules could be appended to the result.
+func NewOrderRules(limits LimitsConfig) []OrderRule {
+	var rules []OrderRule
+
+	if limits.MaxPendingOrders > 0 {
+		rules = append(rules, OrderRule{
+			Name: "max_pending_orders",
+			Check: func(attempt *OrderAttempt) (RiskDecision, error) {
+				// the orders which could not be paid anymore are not pending, even if never cancelled
+				var pending int
+				err := WebData.Model(&Order{}).
+					Where("parent_username = ? AND status = ? AND created_at >= ?",
+						attempt.Username, OrderStatusCreated, attempt.At.Add(-OrderPaymentLifetime)).
+					Count(&pending).Error
+				if err != nil || pending < limits.MaxPendingOrders {
+					return RiskDecision{Action: RiskActionAllow}, err
+				}
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: fmt.Sprintf("未支付的订单过多（最多 %d 笔），请先完成或等待其过期", limits.MaxPendingOrders),
+				}, nil
+			},
+		})
+	}
+
+	if limits.DailyCap > 0 {
+		rules = append(rules, OrderRule{
+			Name: "daily_cap",
+			Check: func(attempt *OrderAttempt) (RiskDecision, error) {
+				spent, err := spentSince(attempt.Username, startOfDay(attempt.At))
+				if err != nil || spent+attempt.Price <= limits.DailyCap {
+					return RiskDecision{Action: RiskActionAllow}, err
+				}
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: fmt.Sprintf("超出每日充值上限 %d", limits.DailyCap),
+				}, nil
+			},
+		})
+	}
+
+	if limits.MonthlyCap > 0 {
+		rules = append(rules, OrderRule{
+			Name: "monthly_cap",
+			Check: func(attempt *OrderAttempt) (RiskDecision, error) {
+				spent, err := spentSince(attempt.Username, startOfMonth(attempt.At))
+				if err != nil || spent+attempt.Price <= limits.MonthlyCap {
+					return RiskDecision{Action: RiskActionAllow}, err
+				}
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: fmt.Sprintf("超出每月充值上限 %d", limits.MonthlyCap),
+				}, nil
+			},
+		})
+	}
+
+	if limits.IPVelocity.MaxOrders > 0 && limits.IPVelocity.Window > 0 {
+		rules = append(rules, OrderRule{
+			Name: "ip_velocity",
+			Check: func(attempt *OrderAttempt) (RiskDecision, error) {
+				var placed int
+				err := WebData.Model(&Order{}).
+					Where("client_ip = ? AND created_at >= ?", attempt.ClientIP, attempt.At.Add(-limits.IPVelocity.Window)).
+					Count(&placed).Error
+				if err != nil || placed < limits.IPVelocity.MaxOrders {
+					return RiskDecision{Action: RiskActionAllow}, err
+				}
+				return RiskDecision{
+					Action: RiskActionReject,
+					Reason: "下单过于频繁，请稍后再试",
+				}, nil
+			},
+		})
+	}
+
+	if limits.ReviewAbove > 0 {
+		rules = append(rules, OrderRule{
+			Name: "review_above",
+			Check: func(attempt *OrderAttempt) (RiskDecision, error) {
+				if attempt.Price <= limits.ReviewAbove {
+					return RiskDecision{Action: RiskActionAllow}, nil
+				}
+				return RiskDecision{
+					Action: RiskActionHold,
+					Reason: fmt.Sprintf("金额超过 %d 需人工审核", limits.ReviewAbove),
+				}, nil
+			},
+		})
+	}
+
+	return rules
+}
+
+// evaluateOrderRules runs rules against attempt. A rejection is recorded as a BlockedOrder,
+// and the reasons of all the holds are joined into the decision.
+func evaluateOrderRules(rules []OrderRule, attempt *OrderAttempt) (RiskDecision, error) {
+	var holds []string
+	var holdRules []string
+	for _, rule := range rules {
+		decision, err := rule.Check(attempt)
+		if err != nil {
+			return RiskDecision{}, err
+		}
+		decision.Rule = rule.Name
+
+		switch decision.Action {
+		case RiskActionReject:
+			err = WebData.Create(&BlockedOrder{
+				Username:  attempt.Username,
+				ClientIP:  attempt.ClientIP,
+				Price:     attempt.Price,
+				PayType:   attempt.PayType,
+				Rule:      decision.Rule,
+				Reason:    decision.Reason,
+				CreatedAt: attempt.At,
+			}).Error
+			if err != nil {
+				LogDb.Errorf("save blocked order error: %v", err)
+			}
+			return decision, nil
+		case RiskActionHold:
+			holds = append(holds, decision.Reason)
+			holdRules = append(holdRules, decision.Rule)
+		}
+	}
+
+	if len(holds) != 0 {
+		return RiskDecision{
+			Action: RiskActionHold,
+			Rule:   strings.Join(holdRules, ","),
+			Reason: strings.Join(holds, "; "),
+		}, nil
+	}
+	return RiskDecision{Action: RiskActionAllow}, nil
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"github.com/labstack/echo"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StatsBucketHour  = "hour"
+	StatsBucketDay   = "day"
+	StatsBucketWeek  = "week"
+	StatsBucketMonth = "month"
+
+	DefaultTimezone      = "Asia/Shanghai"
+	DefaultStatsRange    = time.Hour * 24 * 30
+	DefaultStatsCacheTTL = time.Minute * 5
+	// MaxStatsBuckets bounds the buckets of a single query, e.g. a year of days
+	MaxStatsBuckets = 1000
+	// MaxStatsRange bounds the period aggregated as a whole, by pay types or into the summary
+	MaxStatsRange = time.Hour * 24 * 366
+
+	ErrorMessageTimezoneUnknown = "未知的时区"
+	ErrorMessageStatsRangeError = "统计时间范围无效或过大"
+)
+
+var (
+	ErrStatsTooManyBuckets = errors.New("too many buckets in the range")
+	ErrStatsRangeTooLarge  = errors.New("range too large")
+
+	// statsAggregates are the columns of statsRow aggregated over the orders of a group
+	statsAggregates = "COALESCE(SUM(paid_price), 0) AS paid, COALESCE(SUM(refund_price), 0) AS refunded, " +
+		"COUNT(*) AS paid_orders, COUNT(DISTINCT parent_username) AS paying_users"
+)
+
+// StatsRequest selects the orders aggregated. From and To are dates formatted as 2006-01-02 in Timezone,
+// To being exclusive; the last 30 days are aggregated by default.
+type StatsRequest struct {
+	From     string `query:"from" validate:"omitempty,len=10"`
+	To       string `query:"to" validate:"omitempty,len=10"`
+	Bucket   string `query:"bucket" validate:"omitempty,oneof=hour day week month"`
+	Timezone string `query:"timezone" validate:"max=64"`
+}
+
+// RevenueStats aggregates the orders paid within a period. Revenue is the paid price minus the refunded price.
+type RevenueStats struct {
+	Revenue     uint64 `json:"revenue"`
+	Refunded    uint64 `json:"refunded"`
+	PaidOrders  uint64 `json:"paid_orders"`
+	PayingUsers uint64 `json:"paying_users"`
+	// AverageOrderValue is the average paid price of the paid orders
+	AverageOrderValue float64 `json:"average_order_value"`
+}
+
+type RevenueBucket struct {
+	Start time.Time `json:"start"`
+	RevenueStats
+}
+
+type PayTypeStats struct {
+	PayType string `json:"pay_type"`
+	RevenueStats
+}
+
+// SalesSummary adds the conversion of the orders created within the period
+type SalesSummary struct {
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	CreatedOrders uint64    `json:"created_orders"`
+	// Conversion is the ratio of the orders created within the period which have been paid
+	Conversion float64 `json:"conversion"`
+	RevenueStats
+}
+
+// StatsCache keeps the results of the statistics queries for TTL
+type StatsCache struct {
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]statsCacheEntry
+}
+
+type statsCacheEntry struct {
+	value    interface{}
+	expireAt time.Time
+}
+
+func NewStatsCache(ttl time.Duration) *StatsCache {
+	if ttl == 0 {
+		ttl = DefaultStatsCacheTTL
+	}
+	return &StatsCache{
+		TTL:   ttl,
+		cache: map[string]statsCacheEntry{},
+	}
+}
+
+// Get returns the value cached for key, or computes and caches it
+func (s *StatsCache) Get(key string, compute func() (interface{}, error)) (interface{}, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && entry.expireAt.After(time.Now()) {
+		return entry.value, nil
+	}
+
+	value, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for k, v := range s.cache {
+		if v.expireAt.Before(now) {
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = statsCacheEntry{
+		value:    value,
+		expireAt: now.Add(s.TTL),
+	}
+	s.mu.Unlock()
+	return value, nil
+}
+
+// statsRow is the aggregation of the paid orders of a group
+type statsRow struct {
+	StatsGroup  string
+	Paid        uint64
+	Refunded    uint64
+	PaidOrders  uint64
+	PayingUsers uint64
+}
+
+func (r *statsRow) result() RevenueStats {
+	stats := RevenueStats{
+		Refunded:    r.Refunded,
+		PaidOrders:  r.PaidOrders,
+		PayingUsers: r.PayingUsers,
+	}
+	if r.Paid > r.Refunded {
+		stats.Revenue = r.Paid - r.Refunded
+	}
+	if r.PaidOrders != 0 {
+		stats.AverageOrderValue = float64(r.Paid) / float64(r.PaidOrders)
+	}
+	return stats
+}
+
+// bucketStart truncates t to the start of its bucket in the location of t. Weeks start on Monday.
+func bucketStart(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case StatsBucketHour:
+		y, m, d := t.Date()
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case StatsBucketWeek:
+		day := startOfDay(t)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case StatsBucketMonth:
+		return startOfMonth(t)
+	default:
+		return startOfDay(t)
+	}
+}
+
+func nextBucket(t time.Time, bucket string) time.Time {
+	switch bucket {
+	case StatsBucketHour:
+		return t.Add(time.Hour)
+	case StatsBucketWeek:
+		return t.AddDate(0, 0, 7)
+	case StatsBucketMonth:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// statsBuckets lists the starts of the buckets covering from to to
+func statsBuckets(from time.Time, to time.Time, bucket string) ([]time.Time, error) {
+	var starts []time.Time
+	for t := bucketStart(from, bucket); t.Before(to); t = nextBucket(t, bucket) {
+		if len(starts) >= MaxStatsBuckets {
+			return nil, ErrStatsTooManyBuckets
+		}
+		starts = append(starts, t)
+	}
+	return starts, nil
+}
+
+// statsRange resolves the period and the timezone of a statistics request
+func (r *StatsRequest) statsRange() (from time.Time, to time.Time, err error) {
+	location := Timezone
+	if r.Timezone != "" {
+		if location, err = time.LoadLocation(r.Timezone); err != nil {
+			return
+		}
+	}
+	if r.Bucket == "" {
+		r.Bucket = StatsBucketDay
+	}
+
+	to = startOfDay(time.Now().In(location)).AddDate(0, 0, 1)
+	if r.To != "" {
+		if to, err = time.ParseInLocation("2006-01-02", r.To, location); err != nil {
+			return
+		}
+	}
+	from = to.Add(-DefaultStatsRange)
+	if r.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", r.From, location); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// bindStatsRequest binds the statistics request and checks its range before anything is queried:
+// the buckets are bounded by MaxStatsBuckets if bucketed, otherwise the range by MaxStatsRange
+func bindStatsRequest(c echo.Context, bucketed bool) (*StatsRequest, time.Time, time.Time, error) {
+	var query StatsRequest
+	if err := c.Bind(&query); err != nil {
+		requestLog(c, LogDb).Warnf("bind query error: %v", err)
+		return nil, time.Time{}, time.Time{}, DefaultBadRequestResponse
+	}
+	if err := c.Validate(&query); err != nil {
+		requestLog(c, LogDb).Warnf("validate query error: %v", err)
+		return nil, time.Time{}, time.Time{}, DefaultBadRequestResponse
+	}
+
+	from, to, err := query.statsRange()
+	if err != nil {
+		requestLog(c, LogDb).Errorf("resolve stats range error: %v", err)
+		return nil, time.Time{}, time.Time{}, NewErrorResponse(http.StatusBadRequest, ErrorMessageTimezoneUnknown)
+	}
+	if !from.Before(to) {
+		return nil, time.Time{}, time.Time{}, NewErrorResponse(http.StatusBadRequest, ErrorMessageStatsRangeError)
+	}
+	if bucketed {
+		_, err = statsBuckets(from, to, query.Bucket)
+	} else if to.Sub(from) > MaxStatsRange {
+		err = ErrStatsRangeTooLarge
+	}
+	if err != nil {
+		requestLog(c, LogDb).Warnf("stats range from %s to %s error: %v", from, to, err)
+		return nil, time.Time{}, time.Time{}, NewErrorResponse(http.StatusBadRequest, ErrorMessageStatsRangeError)
+	}
+	return &query, from, to, nil
+}
+
+// aggregateStatsOrders aggregates the orders paid within the period by the group expression, selected along with
+// its args as the stats_group column. The whole period is a single group if group is empty.
+func aggregateStatsOrders(from time.Time, to time.Time, group string, args ...interface{}) ([]statsRow, error) {
+	db := WebData.Model(&Order{}).Where("paid_at >= ? AND paid_at < ?", from, to)
+	if group == "" {
+		db = db.Select(statsAggregates)
+	} else {
+		db = db.Select(group+" AS stats_group, "+statsAggregates, args...).Group("stats_group")
+	}
+	var rows []statsRow
+	err := db.Scan(&rows).Error
+	return rows, err
+}
+
+func revenueByBucket(from time.Time, to time.Time, bucket string) ([]RevenueBucket, error) {
+	starts, err := statsBuckets(from, to, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	// the buckets are told apart by their boundaries, as the database knows nothing about the timezone
+	var group strings.Builder
+	var boundaries []interface{}
+	group.WriteString("CASE")
+	for i := 1; i < len(starts); i++ {
+		group.WriteString(" WHEN paid_at < ? THEN " + strconv.Itoa(i-1))
+		boundaries = append(boundaries, starts[i])
+	}
+	group.WriteString(" ELSE " + strconv.Itoa(len(starts)-1) + " END")
+
+	rows, err := aggregateStatsOrders(from, to, group.String(), boundaries...)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]RevenueBucket, len(starts))
+	for i, start := range starts {
+		buckets[i].Start = start
+	}
+	for i := range rows {
+		if index, err := strconv.Atoi(rows[i].StatsGroup); err == nil && index >= 0 && index < len(buckets) {
+			buckets[index].RevenueStats = rows[i].result()
+		}
+	}
+	return buckets, nil
+}
+
+func revenueByPayType(from time.Time, to time.Time) ([]PayTypeStats, error) {
+	rows, err := aggregateStatsOrders(from, to, "pay_type")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]PayTypeStats, 0, len(rows))
+	for i := range rows {
+		stats = append(stats, PayTypeStats{
+			PayType:      rows[i].StatsGroup,
+			RevenueStats: rows[i].result(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Revenue > stats[j].Revenue
+	})
+	return stats, nil
+}
+
+func salesSummary(from time.Time, to time.Time) (*SalesSummary, error) {
+	rows, err := aggregateStatsOrders(from, to, "")
+	if err != nil {
+		return nil, err
+	}
+
+	summary := SalesSummary{
+		From: from,
+		To:   to,
+	}
+	if len(rows) != 0 {
+		summary.RevenueStats = rows[0].result()
+	}
+
+	var converted uint64
+	err = WebData.Model(&Order{}).Where("created_at >= ? AND created_at < ?", from, to).Count(&summary.CreatedOrders).Error
+	if err == nil {
+		err = WebData.Model(&Order{}).
+			Where("created_at >= ? AND created_at < ? AND paid_at IS NOT NULL", from, to).
+			Count(&converted).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	if summary.CreatedOrders != 0 {
+		summary.Conversion = float64(converted) / float64(summary.CreatedOrders)
+	}
+	return &summary, nil
+}
+
+// cachedStats serves the statistics named kind for the request from StatsResultCache
+func cachedStats(c echo.Context, kind string, bucketed bool, compute func(query *StatsRequest, from time.Time, to time.Time) (interface{}, error)) error {
+	query, from, to, err := bindStatsRequest(c, bucketed)
+	if err != nil {
+		return err
+	}
+
+	// the offsets of the range don't tell the timezone, whose later transitions would shift the buckets
+	key := strings.Join([]string{kind, query.Bucket, from.Location().String(),
+		from.Format(time.RFC3339), to.Format(time.RFC3339)}, "/")
+	result, err := StatsResultCache.Get(key, func() (interface{}, error) {
+		return compute(query, from, to)
+	})
+	if err == ErrStatsTooManyBuckets {
+		return NewErrorResponse(http.StatusBadRequest, ErrorMessageStatsRangeError)
+	} else if err != nil {
+		requestLog(c, LogDb).Errorf("compute %s stats error: %v", kind, err)
+		return NewErrorResponse(http.StatusInternalServerError, ErrorMessageDatabaseError)
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+func getRevenueStats(c echo.Context) error {
+	return cachedStats(c, "revenue", true, func(query *StatsRequest, from time.Time, to time.Time) (interface{}, error) {
+		return revenueByBucket(from, to, query.Bucket)
+	})
+}
+
+func getPayTypeStats(c echo.Context) error {
+	return cachedStats(c, "pay_type", false, func(query *StatsRequest, from time.Time, to time.Time) (interface{}, error) {
+		return revenueByPayType(from, to)
+	})
+}
+
+func getSalesSummary(c echo.Context) error {
+	return cachedStats(c, "summary", false, func(query *StatsRequest, from time.Time, to time.Time) (interface{}, error) {
+		return salesSummary(from, to)
+	})
+}
@@ -6,34 +6,86 @@ import (
 )
 
 type DatabaseConfig struct {
-	Source string `yaml:"source"`
-	DSN    string `yaml:"dsn"`
+	Source string `yaml:"source" validate:"required"`
+	DSN    string `yaml:"dsn" validate:"required"`
 }
 
 type Config struct {
 	Server struct {
-		Address string `yaml:"address"`
-		CORS    struct {
+		Address string `yaml:"address" validate:"required"`
+		// PublicURL is where browsers reach this server, used to build the urls the payment platform redirects to
+		PublicURL string `yaml:"publicUrl"`
+		// OrderPageURL is the frontend page showing an order, with %s replaced by the order id
+		OrderPageURL string `yaml:"orderPageUrl"`
+		// Timezone is where the days of the limits and the statistics begin, Asia/Shanghai by default
+		Timezone string `yaml:"timezone"`
+		// ShutdownTimeout bounds the wait for the requests in flight when terminating, 30s by default
+		ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+		CORS            struct {
 			Enabled      bool     `yaml:"enabled"`
 			AllowOrigins []string `yaml:"allowOrigins"`
 		} `yaml:"cors"`
 	} `yaml:"server"`
 	Database struct {
-		Web    DatabaseConfig `yaml:"web"`
-		AuthMe DatabaseConfig `yaml:"authMe"`
-		Game   DatabaseConfig `yaml:"game"`
+		// MigrateOnStart applies the pending migrations when serving; otherwise run the migrate command beforehand
+		MigrateOnStart bool           `yaml:"migrateOnStart"`
+		Web            DatabaseConfig `yaml:"web"`
+		AuthMe         DatabaseConfig `yaml:"authMe"`
+		Game           DatabaseConfig `yaml:"game"`
 	} `yaml:"database"`
 	Game struct {
-		Address string `yaml:"address"`
+		Address string            `yaml:"address" validate:"required"`
+		Balance GameBalanceConfig `yaml:"balance"`
 	} `yaml:"game"`
 	ReCAPTCHA struct {
-		Secret string `yaml:"secret"`
+		Secret string `yaml:"secret" validate:"required"`
 	} `yaml:"recaptcha"`
 	XorPay struct {
-		AppID     string `yaml:"appId"`
-		AppSecret string `yaml:"appSecret"`
-		NotifyURL string `yaml:"notifyUrl"`
-	}
+		AppID     string `yaml:"appId" validate:"required"`
+		AppSecret string `yaml:"appSecret" validate:"required"`
+		NotifyURL string `yaml:"notifyUrl" validate:"required"`
+		BaseURL   string `yaml:"baseUrl"`
+		// Sandbox serves a fake platform in-process; refused along with BaseURL or an AppSecret not made up for it
+		Sandbox bool `yaml:"sandbox"`
+	} `yaml:"xorpay"`
+	Reconcile struct {
+		Interval time.Duration `yaml:"interval"`
+		Window   time.Duration `yaml:"window"`
+	} `yaml:"reconcile"`
+	QRCode struct {
+		Size  int    `yaml:"size" validate:"omitempty,oneof=128 256 512 1024"`
+		Level string `yaml:"level"`
+		Logo  string `yaml:"logo"`
+	} `yaml:"qrcode"`
+	Log    LogConfig    `yaml:"log"`
+	Limits LimitsConfig `yaml:"limits"`
+	// MinorGroups are the age groups the accounts of minors could be flagged with
+	MinorGroups []MinorGroup `yaml:"minorGroups"`
+	Promotions  []Promotion  `yaml:"promotions"`
+	Metrics     struct {
+		// Token is required from the scrapers of /metrics as a bearer token if set
+		Token string `yaml:"token"`
+	} `yaml:"metrics"`
+	Health struct {
+		// CheckPayment makes /readyz fail when the payment platform is unreachable
+		CheckPayment bool `yaml:"checkPayment"`
+	} `yaml:"health"`
+	Stats struct {
+		// CacheTTL is how long the results of the statistics are cached
+		CacheTTL time.Duration `yaml:"cacheTTL"`
+	} `yaml:"stats"`
+	Admin struct {
+		// Usernames are the AuthMe users always granted the superadmin role, to bootstrap the other roles
+		Usernames []string `yaml:"usernames"`
+	} `yaml:"admin"`
+}
+
+// GameBalanceConfig locates the coin balance of players in the game database.
+// Used when debiting coins of refunded orders; leave Table empty if the balance is not accessible.
+type GameBalanceConfig struct {
+	Table          string `yaml:"table"`
+	UsernameColumn string `yaml:"usernameColumn"`
+	BalanceColumn  string `yaml:"balanceColumn"`
 }
 
 // AuthMeUser describes a AuthMe user object
@@ -63,6 +115,10 @@ type Token struct {
 	Token          string    `gorm:"char(32);primary_key" json:"token"`
 	ExpireAt       time.Time `json:"expire_at"`
 	ParentUsername string    `json:"parent_username"`
+
+	// WeChatOpenID is acquired when paying inside WeChat, OpenIDState guards the acquisition redirect
+	WeChatOpenID string `gorm:"column:wechat_openid;size:64" json:"-"`
+	OpenIDState  string `gorm:"column:openid_state;size:32;index" json:"-"`
 }
 
 // PlatformOrder describes a order object in payment platform.
@@ -85,6 +141,11 @@ type Order struct {
 	PlatformOrderID string `gorm:"size:32;unique_index;NOT NULL" json:"-"`
 	ParentUsername  string `gorm:"size:255;index;NOT NULL" json:"-"`
 	PayType         string `gorm:"size:32;NOT NULL" json:"pay_type"`
+	QRContent       string `gorm:"size:512" json:"-"`
+	ClientIP        string `gorm:"size:64;index" json:"-"`
+	// ReviewReason holds the order for review after being paid, instead of delivering it
+	ReviewReason string `gorm:"size:255" json:"-"`
+	Status       string `gorm:"size:16;index;NOT NULL;default:'created'" json:"status"`
 
 	CreatedAt time.Time `gorm:"NOT NULL" json:"created_at"`
 
@@ -92,12 +153,25 @@ type Order struct {
 	PaidPrice uint64     `gorm:"size:8;NOT NULL" json:"paid_price"`
 	PaidAt    *time.Time `json:"paid_at"`
 
+	PromotionID string `gorm:"size:64" json:"promotion_id"`
+	// PromotionType is recorded at placement, as the promotion could be changed by a reload before the payment
+	PromotionType string `gorm:"size:32" json:"promotion_type"`
+	BonusCoins    uint64 `gorm:"NOT NULL;default:0" json:"bonus_coins"`
+
+	CouponCode    string `gorm:"size:32;index" json:"coupon_code"`
+	DiscountPrice uint64 `gorm:"NOT NULL;default:0" json:"discount_price"`
+
 	TransactionID   string `gorm:"size:64" json:"-"`
 	TransactionType string `gorm:"size:64" json:"transaction_type"`
 	//TransactionBuyer string `json:"-"`
 
 	Processed   bool       `gorm:"-" json:"processed"`
 	ProcessedAt *time.Time `json:"processed_at"`
+
+	RefundPrice     uint64     `gorm:"NOT NULL;default:0" json:"refund_price"`
+	RefundReason    string     `gorm:"size:255" json:"refund_reason"`
+	RefundShortfall uint64     `gorm:"NOT NULL;default:0" json:"refund_shortfall"`
+	RefundedAt      *time.Time `json:"refunded_at"`
 }
 
 func (o *Order) AfterFind() (err error) {
@@ -106,15 +180,36 @@ func (o *Order) AfterFind() (err error) {
 	return
 }
 
+// Coins returns the total amount of coins to be credited for this order,
+// including the price discounted by a coupon and the promotion bonus
+func (o *Order) Coins() uint64 {
+	return o.PaidPrice + o.DiscountPrice + o.BonusCoins
+}
+
 // PaidOrder describes an order which has been paid and is going to be stored in Game Database for topup purposes.
-//type PaidOrder struct {
-//	OrderID   string    `gorm:"size:32;unique_index" json:"order_id"`
-//	Username  string    `gorm:"size:255;index" json:"username"`
-//	CreatedAt time.Time `json:"created_at"`
-//	PaidAt    time.Time `json:"paid_at"`
-//	PaidPrice uint64    `json:"paid_price"`
-//	Processed bool      `json:"processed"`
-//}
+type PaidOrder struct {
+	OrderID   string    `gorm:"size:32;unique_index" json:"order_id"`
+	Username  string    `gorm:"size:255;index" json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	PaidAt    time.Time `json:"paid_at"`
+	PaidPrice uint64    `json:"paid_price"`
+	Coins     uint64    `json:"coins"`
+	Processed bool      `json:"processed"`
+}
+
+// PaymentNotification stores every notification received from the payment platform as it is, with the handling result.
+type PaymentNotification struct {
+	ID              uint      `gorm:"primary_key" json:"id"`
+	PlatformOrderID string    `gorm:"size:32;index;NOT NULL" json:"platform_order_id"`
+	OrderID         string    `gorm:"size:32;index" json:"order_id"`
+	PayPrice        string    `gorm:"size:32" json:"pay_price"`
+	PayTime         string    `gorm:"size:32" json:"pay_time"`
+	Sign            string    `gorm:"size:64" json:"sign"`
+	Detail          string    `gorm:"type:text" json:"detail"`
+	RemoteIP        string    `gorm:"size:64" json:"remote_ip"`
+	Result          string    `gorm:"size:32;NOT NULL" json:"result"`
+	ReceivedAt      time.Time `gorm:"NOT NULL" json:"received_at"`
+}
 
 type EncryptedForm struct {
 	Payload string `json:"payload"`
@@ -0,0 +1,76 @@
+package xorpay
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrPlatformUnavailable when the platform could not be reached, timed out or responded with a server error.
+	ErrPlatformUnavailable = errors.New("xorpay: platform unavailable")
+	// ErrBadResponse when the platform responded successfully with something other than the expected json.
+	ErrBadResponse = errors.New("xorpay: bad platform response")
+	// ErrRequestRejected when the platform refused the request with a client error status, e.g. 403 or 404.
+	ErrRequestRejected = errors.New("xorpay: request rejected")
+	// ErrSignRejected when the platform considers the sign invalid, usually because of a wrong app secret.
+	ErrSignRejected = errors.New("xorpay: sign rejected")
+	// ErrMissingArgument when the platform considers a required parameter missing or malformed.
+	ErrMissingArgument = errors.New("xorpay: missing argument")
+	// ErrOrderExists when an order with the same order id has been created before.
+	ErrOrderExists = errors.New("xorpay: order exists")
+	// ErrOrderNotFound when the platform has no order with the given aoid.
+	ErrOrderNotFound = errors.New("xorpay: order not found")
+	// ErrOrderPaid when an order could not be closed because it has been paid.
+	ErrOrderPaid = errors.New("xorpay: order paid")
+	// ErrOrderNotPaid when an order could not be refunded because it has not been paid.
+	ErrOrderNotPaid = errors.New("xorpay: order not paid")
+	// ErrPriceInvalid when the price is not accepted, e.g. refunding more than paid.
+	ErrPriceInvalid = errors.New("xorpay: price invalid")
+
+	statusErrors = map[string]error{
+		"sign_error":       ErrSignRejected,
+		"missing_argument": ErrMissingArgument,
+		"order_exist":      ErrOrderExists,
+		"not_exist":        ErrOrderNotFound,
+		"order_paid":       ErrOrderPaid,
+		"not_paid":         ErrOrderNotPaid,
+		"fee_error":        ErrPriceInvalid,
+		"over_price":       ErrPriceInvalid,
+	}
+)
+
+// TransportError describes a request which could not be sent or whose response could not be received.
+// Its cause is ErrPlatformUnavailable.
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("%v: send request: %v", ErrPlatformUnavailable, e.Err)
+}
+
+func (e *TransportError) Cause() error {
+	return ErrPlatformUnavailable
+}
+
+// Timeout tells if the request timed out, rather than failing to connect or being cut off.
+func (e *TransportError) Timeout() bool {
+	timeout, ok := e.Err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
+
+// StatusError describes a status other than "ok" returned by the platform which has no dedicated error.
+type StatusError struct {
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("xorpay: platform response not ok: %s", e.Status)
+}
+
+func statusError(status string) error {
+	if err, ok := statusErrors[status]; ok {
+		return err
+	}
+	return &StatusError{Status: status}
+}
@@ -1,12 +1,12 @@
 package xorpay
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"github.com/davecgh/go-spew/spew"
+	"github.com/pkg/errors"
 	"github.com/sethgrid/pester"
 	"net/http"
 	"net/url"
@@ -16,17 +16,101 @@ import (
 )
 
 const (
-	PayURLTemplate = "https://xorpay.com/api/pay/%s"
-	Timeout        = time.Minute
+	DefaultBaseURL    = "https://xorpay.com"
+	PayURLTemplate    = "%s/api/pay/%s"
+	RefundURLTemplate = "%s/api/refund/%s"
+	QueryURLTemplate  = "%s/api/query/%s"
+	// QueryOrderURLTemplate queries an order by the order id of the merchant, within the app
+	QueryOrderURLTemplate = "%s/api/query2/%s"
+	CloseURLTemplate      = "%s/api/close/%s"
+	CashierURLTemplate    = "%s/api/cashier/%s"
+	OpenIDURLTemplate     = "%s/api/openid/%s"
+	Timeout               = time.Minute
+
+	PayTypeAlipay = "alipay"
+	PayTypeNative = "native"
+	PayTypeJSAPI  = "jsapi"
+
+	// DefaultCallTimeout limits every call to the platform, including its retries
+	DefaultCallTimeout = time.Second * 15
+
+	QueryStatusNotExist = "not_exist"
+	QueryStatusNew      = "new"
+	QueryStatusPayed    = "payed"
+	QueryStatusFeeError = "fee_error"
+	QueryStatusSuccess  = "success"
+	QueryStatusExpire   = "expire"
+	QueryStatusRefund   = "refund"
 )
 
+// Location is the time zone of the times formatted by the platform, such as the pay time of the orders.
+// Unrelated to the time zone the days are counted in by the merchant.
+var Location = loadLocation()
+
+// loadLocation loads Asia/Shanghai, falling back to its fixed offset where the time zone database is missing
+func loadLocation() *time.Location {
+	location, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		return time.FixedZone("CST", 8*60*60)
+	}
+	return location
+}
+
+// Option for initializer.
+type Option func(*Session)
+
+// HTTPClient sends requests to the platform. Satisfied by both *http.Client and *pester.Client.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// CallObserver is told about every call to the platform api, e.g. for collecting metrics.
+// api is the name of the endpoint called, such as "pay" or "refund".
+type CallObserver func(api string, duration time.Duration, err error)
+
+// SetHTTPClient sets the client used for all the calls to the platform.
+// Used in tests for stubbing.
+func SetHTTPClient(client HTTPClient) Option {
+	return func(s *Session) {
+		s.Client = client
+		s.OnceClient = client
+	}
+}
+
+// SetCallTimeout sets the deadline of every call to the platform.
+func SetCallTimeout(timeout time.Duration) Option {
+	return func(s *Session) {
+		s.CallTimeout = timeout
+	}
+}
+
+// SetObserver sets the observer of the calls to the platform.
+func SetObserver(observer CallObserver) Option {
+	return func(s *Session) {
+		s.Observer = observer
+	}
+}
+
+// SetBaseURL sets the url the platform api is served at, e.g. a xorpaytest.Server.
+func SetBaseURL(baseUrl string) Option {
+	return func(s *Session) {
+		s.BaseURL = strings.TrimSuffix(baseUrl, "/")
+	}
+}
+
 type Session struct {
 	NotifyURL string `json:"notify_url"`
 	AppID     string `json:"app_id"`
 	AppSecret string `json:"app_secret"`
+	BaseURL   string `json:"base_url"`
 	PayURL    string `json:"pay_url"`
 
-	Client pester.Client `json:"-"`
+	// Client sends the calls which could be retried safely, i.e. query and close
+	Client HTTPClient `json:"-"`
+	// OnceClient sends the calls which would be duplicated if retried, i.e. pay and refund
+	OnceClient  HTTPClient    `json:"-"`
+	CallTimeout time.Duration `json:"-"`
+	Observer    CallObserver  `json:"-"`
 }
 
 type Transaction struct {
@@ -34,15 +118,57 @@ type Transaction struct {
 	PayType string `json:"pay_type"`
 	Price   uint64 `json:"price"`
 	OrderID string `json:"order_id"`
+	// OpenID identifies the WeChat user paying. Required by PayTypeJSAPI only.
+	OpenID string `json:"openid"`
+}
+
+// JSAPIParams are passed to WeixinJSBridge.invoke("getBrandWCPayRequest") to pay inside WeChat
+type JSAPIParams struct {
+	AppID     string `json:"appId"`
+	TimeStamp string `json:"timeStamp"`
+	NonceStr  string `json:"nonceStr"`
+	Package   string `json:"package"`
+	SignType  string `json:"signType"`
+	PaySign   string `json:"paySign"`
+}
+
+// PayInfo holds the QR content for PayTypeAlipay and PayTypeNative, or the JSAPIParams for PayTypeJSAPI
+type PayInfo struct {
+	QR string `json:"qr,omitempty"`
+	JSAPIParams
 }
 
 type PlatformPayResponse struct {
-	Status          string `json:"status"`
-	ExpiresIn       uint   `json:"expires_in"`
+	Status          string  `json:"status"`
+	ExpiresIn       uint    `json:"expires_in"`
+	PlatformOrderID string  `json:"aoid"`
+	Info            PayInfo `json:"info"`
+}
+
+type PlatformCloseResponse struct {
+	Status string `json:"status"`
+}
+
+type PlatformRefundResponse struct {
+	Status string `json:"status"`
+}
+
+type PlatformQueryResponse struct {
+	// PlatformOrderID is only returned when queried by the order id
 	PlatformOrderID string `json:"aoid"`
-	Info            struct {
-		QR string `json:"qr"`
-	} `json:"info"`
+	Status          string `json:"status"`
+	PayPrice        string `json:"pay_price"`
+	PayTime         string `json:"pay_time"`
+}
+
+// Paid tells if the order has been paid by the buyer according to the platform
+func (r *PlatformQueryResponse) Paid() bool {
+	return r.Status == QueryStatusPayed || r.Status == QueryStatusSuccess
+}
+
+// Refunded tells if the order has been paid, then refunded back to the buyer according to the platform
+func (r *PlatformQueryResponse) Refunded() bool {
+	return r.Status == QueryStatusRefund
 }
 
 type PlatformNotifyResponse struct {
@@ -60,20 +186,32 @@ type PlatformNotifyResponseDetail struct {
 	TransactionBuyer string `json:"buyer"`
 }
 
-func New(notifyUrl string, appId string, appSecret string) Session {
-	return Session{
+func New(notifyUrl string, appId string, appSecret string, options ...Option) Session {
+	s := Session{
 		NotifyURL: notifyUrl,
 		AppID:     appId,
 		AppSecret: appSecret,
-		PayURL:    fmt.Sprintf(PayURLTemplate, appId),
-		Client: pester.Client{
-			Concurrency: 3,
-			Timeout:     5,
-			MaxRetries:  3,
-			Backoff:     pester.ExponentialJitterBackoff,
-			KeepLog:     true,
-		},
+		BaseURL:   DefaultBaseURL,
+
+		CallTimeout: DefaultCallTimeout,
 	}
+
+	// requests are not sent concurrently, and the pay and refund requests are not retried at all,
+	// as paying twice would create the order twice and refunding twice would refund twice
+	client := pester.New()
+	client.Concurrency = 1
+	client.MaxRetries = 3
+	client.Backoff = pester.ExponentialJitterBackoff
+	client.KeepLog = true
+	s.Client = client
+	s.OnceClient = &http.Client{}
+
+	for _, option := range options {
+		option(&s)
+	}
+
+	s.PayURL = fmt.Sprintf(PayURLTemplate, s.BaseURL, appId)
+	return s
 }
 
 func calculateSign(t Transaction, s Session) string {
@@ -89,9 +227,56 @@ func calculateSign(t Transaction, s Session) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// call sends a request to the platform and decodes the json response into v.
+// form is posted if not nil, otherwise a GET request is sent.
+func (s Session) call(ctx context.Context, client HTTPClient, api string, endpoint string, form url.Values, v interface{}) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, s.CallTimeout)
+	defer cancel()
+
+	if s.Observer != nil {
+		start := time.Now()
+		defer func() {
+			s.Observer(api, time.Since(start), err)
+		}()
+	}
+
+	var req *http.Request
+	if form != nil {
+		req, err = http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest(http.MethodGet, endpoint, nil)
+	}
+	if err != nil {
+		return errors.Wrap(err, "new request")
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &TransportError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Wrapf(ErrPlatformUnavailable, "http status %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.Wrapf(ErrRequestRejected, "http status %d", resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrapf(ErrBadResponse, "unmarshal api response: %v", err)
+	}
+	return nil
+}
+
 // Pay sends order info to xorpay
 // returns payment response, error
-func (s Session) Pay(t Transaction) (payResponse *PlatformPayResponse, err error) {
+// The request is sent once. When failed with ErrPlatformUnavailable, the order might have been created nonetheless,
+// which is told by QueryOrder.
+func (s Session) Pay(ctx context.Context, t Transaction) (payResponse *PlatformPayResponse, err error) {
 	v := url.Values{}
 	v.Set("name", t.Name)
 	v.Set("pay_type", t.PayType)
@@ -99,24 +284,112 @@ func (s Session) Pay(t Transaction) (payResponse *PlatformPayResponse, err error
 	v.Set("order_id", t.OrderID)
 	v.Set("notify_url", s.NotifyURL)
 	v.Set("sign", calculateSign(t, s))
-
-	resp, err := http.PostForm(s.PayURL, v)
-	if err != nil {
-		return &PlatformPayResponse{}, err
+	if t.PayType == PayTypeJSAPI {
+		v.Set("openid", t.OpenID)
 	}
 
 	var platformPayResponse PlatformPayResponse
-	err = json.NewDecoder(resp.Body).Decode(&platformPayResponse)
-	if err != nil {
+	if err = s.call(ctx, s.OnceClient, "pay", s.PayURL, v, &platformPayResponse); err != nil {
 		return &PlatformPayResponse{}, err
 	}
 	if platformPayResponse.Status != "ok" {
-		return &PlatformPayResponse{}, errors.New(fmt.Sprintf("platform response not ok: %s", platformPayResponse.Status))
+		return &PlatformPayResponse{}, statusError(platformPayResponse.Status)
 	}
 
 	return &platformPayResponse, nil
 }
 
+// Refund refunds price of the paid order identified by platformOrderId (aoid) back to the buyer
+func (s Session) Refund(ctx context.Context, platformOrderId string, price uint64) error {
+	priceString := strconv.FormatUint(price, 10)
+	hash := md5.Sum([]byte(priceString + s.AppSecret))
+
+	v := url.Values{}
+	v.Set("price", priceString)
+	v.Set("sign", hex.EncodeToString(hash[:]))
+
+	var platformRefundResponse PlatformRefundResponse
+	err := s.call(ctx, s.OnceClient, "refund", fmt.Sprintf(RefundURLTemplate, s.BaseURL, platformOrderId), v, &platformRefundResponse)
+	if err != nil {
+		return err
+	}
+	if platformRefundResponse.Status != "ok" {
+		return statusError(platformRefundResponse.Status)
+	}
+
+	return nil
+}
+
+// Query retrieves the status of the order identified by platformOrderId (aoid) from the platform
+func (s Session) Query(ctx context.Context, platformOrderId string) (*PlatformQueryResponse, error) {
+	var platformQueryResponse PlatformQueryResponse
+	err := s.call(ctx, s.Client, "query", fmt.Sprintf(QueryURLTemplate, s.BaseURL, platformOrderId), nil, &platformQueryResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &platformQueryResponse, nil
+}
+
+// QueryOrder retrieves the status of the order created with orderId from the platform,
+// e.g. when its aoid is not known because it has been created on the cashier page
+func (s Session) QueryOrder(ctx context.Context, orderId string) (*PlatformQueryResponse, error) {
+	hash := md5.Sum([]byte(orderId + s.AppSecret))
+
+	v := url.Values{}
+	v.Set("order_id", orderId)
+	v.Set("sign", hex.EncodeToString(hash[:]))
+
+	var platformQueryResponse PlatformQueryResponse
+	endpoint := fmt.Sprintf(QueryOrderURLTemplate, s.BaseURL, s.AppID) + "?" + v.Encode()
+	if err := s.call(ctx, s.Client, "query", endpoint, nil, &platformQueryResponse); err != nil {
+		return nil, err
+	}
+
+	return &platformQueryResponse, nil
+}
+
+// Close closes the unpaid order identified by platformOrderId (aoid), so that it could not be paid anymore
+func (s Session) Close(ctx context.Context, platformOrderId string) error {
+	hash := md5.Sum([]byte(platformOrderId + s.AppSecret))
+
+	v := url.Values{}
+	v.Set("sign", hex.EncodeToString(hash[:]))
+
+	var platformCloseResponse PlatformCloseResponse
+	err := s.call(ctx, s.Client, "close", fmt.Sprintf(CloseURLTemplate, s.BaseURL, platformOrderId), v, &platformCloseResponse)
+	if err != nil {
+		return err
+	}
+	if platformCloseResponse.Status != "ok" {
+		return statusError(platformCloseResponse.Status)
+	}
+
+	return nil
+}
+
+// CashierURL builds the url of the cashier page hosted by the platform, where the buyer chooses how to pay.
+// The buyer is sent back to returnUrl once paid. No request is sent until the buyer opens the url.
+func (s Session) CashierURL(t Transaction, returnUrl string) string {
+	v := url.Values{}
+	v.Set("name", t.Name)
+	v.Set("pay_type", t.PayType)
+	v.Set("price", strconv.FormatUint(t.Price, 10))
+	v.Set("order_id", t.OrderID)
+	v.Set("notify_url", s.NotifyURL)
+	v.Set("return_url", returnUrl)
+	v.Set("sign", calculateSign(t, s))
+	return fmt.Sprintf(CashierURLTemplate, s.BaseURL, s.AppID) + "?" + v.Encode()
+}
+
+// OpenIDURL builds the url which acquires the WeChat openid of the buyer, required by PayTypeJSAPI.
+// It has to be opened inside WeChat, and redirects to callback with the openid appended as the `openid` query parameter.
+func (s Session) OpenIDURL(callback string) string {
+	v := url.Values{}
+	v.Set("callback", callback)
+	return fmt.Sprintf(OpenIDURLTemplate, s.BaseURL, s.AppID) + "?" + v.Encode()
+}
+
 func (s Session) CheckSign(r *PlatformNotifyResponse) bool {
 	concatenated := strings.Join([]string{
 		r.PlatformOrderID,
@@ -127,6 +400,5 @@ func (s Session) CheckSign(r *PlatformNotifyResponse) bool {
 	}, "")
 	sumBytes := md5.Sum([]byte(concatenated))
 	sumHex := hex.EncodeToString(sumBytes[:])
-	spew.Dump(r, concatenated, sumBytes, sumHex)
 	return sumHex == r.Sign
 }
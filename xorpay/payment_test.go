@@ -0,0 +1,369 @@
+package xorpay
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+const (
+	testAppID     = "4415"
+	testAppSecret = "0123456789abcdef0123456789abcdef"
+	testNotifyURL = "https://floatdream.cn/api/topup/order/callback"
+	testOrderID   = "8Xq2mZ7kLp4Rt9Vw3Yb6Nc1Hd5Fg0Js2"
+	testAoid      = "c8f1e2a9b3d44e7f8a6b5c4d3e2f1a0b"
+)
+
+var testTransaction = Transaction{
+	Name:    "FloatDream 100 coins",
+	PayType: PayTypeNative,
+	Price:   100,
+	OrderID: testOrderID,
+}
+
+// fixtureClient answers every request with a response recorded from the platform, remembering the requests
+type fixtureClient struct {
+	status int
+	body   string
+	err    error
+
+	requests []*http.Request
+	forms    []url.Values
+}
+
+func (c *fixtureClient) Do(req *http.Request) (*http.Response, error) {
+	c.requests = append(c.requests, req)
+	form := url.Values{}
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		form, _ = url.ParseQuery(string(body))
+	}
+	c.forms = append(c.forms, form)
+
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &http.Response{
+		StatusCode: c.status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(c.body)),
+		Request:    req,
+	}, nil
+}
+
+func loadFixture(t *testing.T, name string) string {
+	t.Helper()
+	body, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture %s: %v", name, err)
+	}
+	return string(body)
+}
+
+func newFixtureSession(t *testing.T, status int, fixture string) (Session, *fixtureClient) {
+	t.Helper()
+	client := &fixtureClient{status: status}
+	if fixture != "" {
+		client.body = loadFixture(t, fixture)
+	}
+	return New(testNotifyURL, testAppID, testAppSecret, SetHTTPClient(client)), client
+}
+
+func assertCause(t *testing.T, err error, expected error) {
+	t.Helper()
+	if pkgerrors.Cause(err) != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+}
+
+func TestCalculateSign(t *testing.T) {
+	session := New(testNotifyURL, testAppID, testAppSecret)
+	// md5 of name, pay_type, price, order_id, notify_url and the app secret, concatenated
+	if sign := calculateSign(testTransaction, session); sign != "d9af1402b1a61cd78ebfe5c54c3192e7" {
+		t.Fatalf("unexpected sign %s", sign)
+	}
+}
+
+func TestPay(t *testing.T) {
+	session, client := newFixtureSession(t, http.StatusOK, "pay_ok.json")
+
+	response, err := session.Pay(context.Background(), testTransaction)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	if response.PlatformOrderID != testAoid || response.ExpiresIn != 7200 || response.Info.QR != "weixin://wxpay/bizpayurl?pr=Ab3dEfG" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+
+	if len(client.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(client.requests))
+	}
+	req := client.requests[0]
+	if req.Method != http.MethodPost || req.URL.String() != "https://xorpay.com/api/pay/"+testAppID {
+		t.Fatalf("unexpected request %s %s", req.Method, req.URL)
+	}
+	form := client.forms[0]
+	for key, expected := range map[string]string{
+		"name":       testTransaction.Name,
+		"pay_type":   PayTypeNative,
+		"price":      "100",
+		"order_id":   testOrderID,
+		"notify_url": testNotifyURL,
+		"sign":       "d9af1402b1a61cd78ebfe5c54c3192e7",
+	} {
+		if form.Get(key) != expected {
+			t.Errorf("form %s: expected %q, got %q", key, expected, form.Get(key))
+		}
+	}
+	if _, ok := form["openid"]; ok {
+		t.Errorf("openid sent for a native payment")
+	}
+}
+
+func TestPayJSAPI(t *testing.T) {
+	session, client := newFixtureSession(t, http.StatusOK, "pay_jsapi_ok.json")
+
+	transaction := testTransaction
+	transaction.PayType = PayTypeJSAPI
+	transaction.OpenID = "oUpF8uMuAJO_M2pxb1Q9zNjWeS6o"
+	response, err := session.Pay(context.Background(), transaction)
+	if err != nil {
+		t.Fatalf("pay: %v", err)
+	}
+	if response.Info.Package != "prepay_id=wx201410272009395522657a690389285100" || response.Info.SignType != "MD5" {
+		t.Fatalf("unexpected jsapi params %+v", response.Info.JSAPIParams)
+	}
+	if client.forms[0].Get("openid") != transaction.OpenID {
+		t.Fatalf("openid not sent")
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		fixture  string
+		call     func(s Session) error
+		expected error
+	}{
+		{"pay_sign_error.json", func(s Session) error { _, err := s.Pay(ctx, testTransaction); return err }, ErrSignRejected},
+		{"pay_order_exist.json", func(s Session) error { _, err := s.Pay(ctx, testTransaction); return err }, ErrOrderExists},
+		{"pay_missing_argument.json", func(s Session) error { _, err := s.Pay(ctx, testTransaction); return err }, ErrMissingArgument},
+		{"refund_not_paid.json", func(s Session) error { return s.Refund(ctx, testAoid, 10) }, ErrOrderNotPaid},
+		{"refund_over_price.json", func(s Session) error { return s.Refund(ctx, testAoid, 1000) }, ErrPriceInvalid},
+		{"close_order_paid.json", func(s Session) error { return s.Close(ctx, testAoid) }, ErrOrderPaid},
+		{"close_not_exist.json", func(s Session) error { return s.Close(ctx, testAoid) }, ErrOrderNotFound},
+	} {
+		t.Run(test.fixture, func(t *testing.T) {
+			session, _ := newFixtureSession(t, http.StatusOK, test.fixture)
+			assertCause(t, test.call(session), test.expected)
+		})
+	}
+}
+
+func TestUnknownStatus(t *testing.T) {
+	session, _ := newFixtureSession(t, http.StatusOK, "pay_unknown_status.json")
+
+	_, err := session.Pay(context.Background(), testTransaction)
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Status != "app_frozen" {
+		t.Fatalf("expected StatusError app_frozen, got %v", err)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	session, client := newFixtureSession(t, http.StatusOK, "refund_ok.json")
+
+	if err := session.Refund(context.Background(), testAoid, 10); err != nil {
+		t.Fatalf("refund: %v", err)
+	}
+	if client.requests[0].URL.Path != "/api/refund/"+testAoid {
+		t.Fatalf("unexpected path %s", client.requests[0].URL.Path)
+	}
+	// md5 of price and the app secret
+	if sign := client.forms[0].Get("sign"); sign != "f27ca3ece95fce3889ac73334e1f15fb" {
+		t.Fatalf("unexpected sign %s", sign)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	session, client := newFixtureSession(t, http.StatusOK, "query_payed.json")
+
+	response, err := session.Query(context.Background(), testAoid)
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	if !response.Paid() || response.PayPrice != "100.00" || response.PayTime != "2020-01-24 12:30:05" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if client.requests[0].Method != http.MethodGet {
+		t.Fatalf("query sent as %s", client.requests[0].Method)
+	}
+
+	session, _ = newFixtureSession(t, http.StatusOK, "query_new.json")
+	if response, err = session.Query(context.Background(), testAoid); err != nil || response.Paid() {
+		t.Fatalf("expected an unpaid order, got %+v, %v", response, err)
+	}
+
+	session, _ = newFixtureSession(t, http.StatusOK, "query_refund.json")
+	response, err = session.Query(context.Background(), testAoid)
+	if err != nil || response.Paid() || !response.Refunded() || response.PayPrice != "100.00" {
+		t.Fatalf("expected a refunded order, got %+v, %v", response, err)
+	}
+}
+
+func TestQueryOrder(t *testing.T) {
+	session, client := newFixtureSession(t, http.StatusOK, "query_order_payed.json")
+
+	response, err := session.QueryOrder(context.Background(), testOrderID)
+	if err != nil {
+		t.Fatalf("query order: %v", err)
+	}
+	if !response.Paid() || response.PlatformOrderID != testAoid || response.PayPrice != "100.00" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	query := client.requests[0].URL.Query()
+	if client.requests[0].URL.Path != "/api/query2/"+testAppID || query.Get("order_id") != testOrderID {
+		t.Fatalf("unexpected request %s", client.requests[0].URL)
+	}
+	// md5 of the order id and the app secret
+	if query.Get("sign") != "d0691a8a98fd4013a166c3bd89184e8c" {
+		t.Fatalf("unexpected sign %s", query.Get("sign"))
+	}
+}
+
+func TestClose(t *testing.T) {
+	session, client := newFixtureSession(t, http.StatusOK, "close_ok.json")
+
+	if err := session.Close(context.Background(), testAoid); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	// md5 of the aoid and the app secret
+	if sign := client.forms[0].Get("sign"); sign != "252074c0c14cf51b933a6b0d156c6b8b" {
+		t.Fatalf("unexpected sign %s", sign)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable} {
+		session, _ := newFixtureSession(t, status, "gateway_error.html")
+		_, err := session.Pay(context.Background(), testTransaction)
+		assertCause(t, err, ErrPlatformUnavailable)
+	}
+
+	client := &fixtureClient{err: errors.New("dial tcp 203.0.113.7:443: connect: connection refused")}
+	session := New(testNotifyURL, testAppID, testAppSecret, SetHTTPClient(client))
+	err := session.Close(context.Background(), testAoid)
+	assertCause(t, err, ErrPlatformUnavailable)
+	if transportErr, ok := err.(*TransportError); !ok || transportErr.Timeout() {
+		t.Fatalf("expected a transport error other than a timeout, got %#v", err)
+	}
+
+	client.err = &url.Error{Op: "Post", URL: session.PayURL, Err: context.DeadlineExceeded}
+	_, err = session.Pay(context.Background(), testTransaction)
+	assertCause(t, err, ErrPlatformUnavailable)
+	if transportErr, ok := err.(*TransportError); !ok || !transportErr.Timeout() {
+		t.Fatalf("expected a transport error timing out, got %#v", err)
+	}
+}
+
+func TestPayNotRetried(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	session := New(testNotifyURL, testAppID, testAppSecret, SetBaseURL(server.URL))
+	_, err := session.Pay(context.Background(), testTransaction)
+	assertCause(t, err, ErrPlatformUnavailable)
+	if sent := atomic.LoadInt32(&requests); sent != 1 {
+		t.Fatalf("pay sent %d times", sent)
+	}
+
+	assertCause(t, session.Refund(context.Background(), testAoid, 100), ErrPlatformUnavailable)
+	if sent := atomic.LoadInt32(&requests); sent != 2 {
+		t.Fatalf("refund sent %d times", sent-1)
+	}
+}
+
+func TestUndecodableResponses(t *testing.T) {
+	for _, test := range []struct {
+		status  int
+		fixture string
+	}{
+		{http.StatusOK, "gateway_error.html"},
+		{http.StatusOK, "truncated.json"},
+	} {
+		session, _ := newFixtureSession(t, test.status, test.fixture)
+		_, err := session.Query(context.Background(), testAoid)
+		assertCause(t, err, ErrBadResponse)
+	}
+}
+
+func TestRejectedRequests(t *testing.T) {
+	for _, status := range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound} {
+		session, _ := newFixtureSession(t, status, "gateway_error.html")
+		assertCause(t, session.Refund(context.Background(), testAoid, 100), ErrRequestRejected)
+	}
+}
+
+func TestCashierURL(t *testing.T) {
+	session := New(testNotifyURL, testAppID, testAppSecret)
+
+	cashier, err := url.Parse(session.CashierURL(testTransaction, "https://floatdream.cn/return"))
+	if err != nil {
+		t.Fatalf("parse cashier url: %v", err)
+	}
+	if cashier.Host != "xorpay.com" || cashier.Path != "/api/cashier/"+testAppID {
+		t.Fatalf("unexpected cashier url %s", cashier)
+	}
+	q := cashier.Query()
+	if q.Get("sign") != "d9af1402b1a61cd78ebfe5c54c3192e7" || q.Get("return_url") != "https://floatdream.cn/return" ||
+		q.Get("order_id") != testOrderID || q.Get("notify_url") != testNotifyURL {
+		t.Fatalf("unexpected cashier query %v", q)
+	}
+}
+
+func TestOpenIDURL(t *testing.T) {
+	session := New(testNotifyURL, testAppID, testAppSecret, SetBaseURL("https://sandbox.example/"))
+
+	openid, err := url.Parse(session.OpenIDURL("https://floatdream.cn/api/topup/wechat/openid/callback?state=abc"))
+	if err != nil {
+		t.Fatalf("parse openid url: %v", err)
+	}
+	if openid.Host != "sandbox.example" || openid.Path != "/api/openid/"+testAppID {
+		t.Fatalf("unexpected openid url %s", openid)
+	}
+	if openid.Query().Get("callback") != "https://floatdream.cn/api/topup/wechat/openid/callback?state=abc" {
+		t.Fatalf("callback not preserved: %v", openid.Query())
+	}
+}
+
+func TestCheckSign(t *testing.T) {
+	session := New(testNotifyURL, testAppID, testAppSecret)
+	notification := PlatformNotifyResponse{
+		PlatformOrderID: testAoid,
+		OrderID:         testOrderID,
+		PayPrice:        "100.00",
+		PayTime:         "2020-01-24 12:30:05",
+		Sign:            "fd2865f5dcc3ce4f905bf446ba6cbad3",
+	}
+	if !session.CheckSign(&notification) {
+		t.Fatalf("valid sign rejected")
+	}
+
+	notification.PayPrice = "1000.00"
+	if session.CheckSign(&notification) {
+		t.Fatalf("tampered notification accepted")
+	}
+}
@@ -0,0 +1,418 @@
+// Package xorpaytest provides an in-process fake of the XorPay platform,
+// to be used with xorpay.SetBaseURL when testing the whole order flow offline.
+package xorpaytest
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/GalvinGao/floatdream-backend/xorpay"
+	"github.com/dchest/uniuri"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ExpiresIn is the lifetime of the QR codes issued by the fake platform, in seconds
+	ExpiresIn = 7200
+
+	StatusSignError  = "sign_error"
+	StatusMissing    = "missing_argument"
+	StatusNotPaid    = "not_paid"
+	StatusOverPrice  = "over_price"
+	StatusOrderExist = "order_exist"
+	StatusPaid       = "order_paid"
+)
+
+var (
+	ErrOrderNotFound = errors.New("xorpaytest: order not found")
+	ErrOrderPaid     = errors.New("xorpaytest: order has been paid already")
+	ErrOrderNotPaid  = errors.New("xorpaytest: order has not been paid")
+	ErrOrderClosed   = errors.New("xorpaytest: order has been closed")
+
+	aoidCharCandidates = []byte("abcdef0123456789")
+)
+
+// Order describes an order created on the fake platform
+type Order struct {
+	PlatformOrderID string
+	OrderID         string
+	Name            string
+	PayType         string
+	Price           uint64
+	NotifyURL       string
+	ReturnURL       string
+	OpenID          string
+	CreatedAt       time.Time
+	Closed          bool
+	PaidAt          *time.Time
+	RefundedPrice   uint64
+	Notifications   int
+}
+
+// Server is a fake XorPay platform serving the pay, cashier, openid, query, close and refund api over HTTP
+type Server struct {
+	*httptest.Server
+
+	AppID     string
+	AppSecret string
+
+	// NotifyClient is used when firing notifications; replace it to route them in-process
+	NotifyClient *http.Client
+
+	mu     sync.Mutex
+	orders map[string]*Order
+}
+
+// NewServer starts a fake platform which accepts requests signed with appSecret for appId.
+// The caller should call Close when finished, to shut it down.
+func NewServer(appId string, appSecret string) *Server {
+	s := &Server{
+		AppID:        appId,
+		AppSecret:    appSecret,
+		NotifyClient: http.DefaultClient,
+		orders:       map[string]*Order{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/pay/", s.handlePay)
+	mux.HandleFunc("/api/query/", s.handleQuery)
+	mux.HandleFunc("/api/query2/", s.handleQueryOrder)
+	mux.HandleFunc("/api/refund/", s.handleRefund)
+	mux.HandleFunc("/api/close/", s.handleClose)
+	mux.HandleFunc("/api/cashier/", s.handleCashier)
+	mux.HandleFunc("/api/openid/", s.handleOpenID)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func md5Hex(parts ...string) string {
+	sum := md5.Sum([]byte(strings.Join(parts, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+func formatPrice(price uint64) string {
+	return strconv.FormatUint(price, 10) + ".00"
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeStatus(w http.ResponseWriter, status string) {
+	writeJSON(w, map[string]string{"status": status})
+}
+
+// createOrder validates the signed order parameters of a pay or cashier request and stores the order.
+// returns the status to respond with if the parameters are not accepted.
+func (s *Server) createOrder(f url.Values) (*Order, string) {
+	price, err := strconv.ParseUint(f.Get("price"), 10, 64)
+	if err != nil || f.Get("order_id") == "" || f.Get("notify_url") == "" {
+		return nil, StatusMissing
+	}
+	if f.Get("pay_type") == xorpay.PayTypeJSAPI && f.Get("openid") == "" {
+		return nil, StatusMissing
+	}
+	sign := md5Hex(f.Get("name"), f.Get("pay_type"), f.Get("price"), f.Get("order_id"), f.Get("notify_url"), s.AppSecret)
+	if sign != f.Get("sign") {
+		return nil, StatusSignError
+	}
+
+	order := &Order{
+		PlatformOrderID: uniuri.NewLenChars(32, aoidCharCandidates),
+		OrderID:         f.Get("order_id"),
+		Name:            f.Get("name"),
+		PayType:         f.Get("pay_type"),
+		Price:           price,
+		NotifyURL:       f.Get("notify_url"),
+		ReturnURL:       f.Get("return_url"),
+		OpenID:          f.Get("openid"),
+		CreatedAt:       time.Now(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.orders {
+		if existing.OrderID == order.OrderID {
+			return nil, StatusOrderExist
+		}
+	}
+	s.orders[order.PlatformOrderID] = order
+	return order, ""
+}
+
+func (s *Server) handlePay(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/api/pay/") != s.AppID {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeStatus(w, StatusMissing)
+		return
+	}
+
+	order, status := s.createOrder(r.PostForm)
+	if order == nil {
+		writeStatus(w, status)
+		return
+	}
+
+	var response xorpay.PlatformPayResponse
+	response.Status = "ok"
+	response.ExpiresIn = ExpiresIn
+	response.PlatformOrderID = order.PlatformOrderID
+	if order.PayType == xorpay.PayTypeJSAPI {
+		response.Info.JSAPIParams = xorpay.JSAPIParams{
+			AppID:     "wx" + s.AppID,
+			TimeStamp: strconv.FormatInt(order.CreatedAt.Unix(), 10),
+			NonceStr:  uniuri.New(),
+			Package:   "prepay_id=wx" + order.PlatformOrderID,
+			SignType:  "MD5",
+			PaySign:   md5Hex(order.PlatformOrderID, s.AppSecret),
+		}
+	} else {
+		response.Info.QR = fmt.Sprintf("%s/qr/%s", s.URL, order.PlatformOrderID)
+	}
+	writeJSON(w, response)
+}
+
+func (s *Server) handleCashier(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/api/cashier/") != s.AppID {
+		http.NotFound(w, r)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, StatusMissing, http.StatusBadRequest)
+		return
+	}
+
+	order, status := s.createOrder(r.Form)
+	if order == nil {
+		http.Error(w, status, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = fmt.Fprintf(w, "<html><body><h1>%s</h1><p>%s</p><p>%s</p></body></html>",
+		html.EscapeString(order.Name), formatPrice(order.Price), order.PlatformOrderID)
+}
+
+// handleOpenID redirects to the callback with an openid derived from the remote address,
+// as if the buyer had authorized inside WeChat
+func (s *Server) handleOpenID(w http.ResponseWriter, r *http.Request) {
+	callback, err := url.Parse(r.URL.Query().Get("callback"))
+	if err != nil || callback.Host == "" {
+		http.Error(w, StatusMissing, http.StatusBadRequest)
+		return
+	}
+
+	q := callback.Query()
+	q.Set("openid", "o"+md5Hex(r.RemoteAddr, s.AppID)[:27])
+	callback.RawQuery = q.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+func (s *Server) handleClose(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeStatus(w, StatusMissing)
+		return
+	}
+	aoid := strings.TrimPrefix(r.URL.Path, "/api/close/")
+	if md5Hex(aoid, s.AppSecret) != r.PostForm.Get("sign") {
+		writeStatus(w, StatusSignError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[aoid]
+	switch {
+	case !ok:
+		writeStatus(w, xorpay.QueryStatusNotExist)
+	case order.PaidAt != nil:
+		writeStatus(w, StatusPaid)
+	default:
+		order.Closed = true
+		writeStatus(w, "ok")
+	}
+}
+
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[strings.TrimPrefix(r.URL.Path, "/api/query/")]
+	if !ok {
+		writeStatus(w, xorpay.QueryStatusNotExist)
+		return
+	}
+	writeJSON(w, queryResponse(order))
+}
+
+func (s *Server) handleQueryOrder(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, "/api/query2/") != s.AppID {
+		http.NotFound(w, r)
+		return
+	}
+	orderId := r.URL.Query().Get("order_id")
+	if md5Hex(orderId, s.AppSecret) != r.URL.Query().Get("sign") {
+		writeStatus(w, StatusSignError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, order := range s.orders {
+		if order.OrderID == orderId {
+			response := queryResponse(order)
+			response.PlatformOrderID = order.PlatformOrderID
+			writeJSON(w, response)
+			return
+		}
+	}
+	writeStatus(w, xorpay.QueryStatusNotExist)
+}
+
+func queryResponse(order *Order) xorpay.PlatformQueryResponse {
+	response := xorpay.PlatformQueryResponse{
+		Status:   xorpay.QueryStatusNew,
+		PayPrice: formatPrice(order.Price),
+	}
+	if order.RefundedPrice != 0 {
+		response.Status = xorpay.QueryStatusRefund
+		response.PayTime = order.PaidAt.In(xorpay.Location).Format("2006-01-02 15:04:05")
+	} else if order.PaidAt != nil {
+		response.Status = xorpay.QueryStatusPayed
+		response.PayTime = order.PaidAt.In(xorpay.Location).Format("2006-01-02 15:04:05")
+	} else if order.Closed {
+		response.Status = xorpay.QueryStatusExpire
+	}
+	return response
+}
+
+func (s *Server) handleRefund(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeStatus(w, StatusMissing)
+		return
+	}
+	price, err := strconv.ParseUint(r.PostForm.Get("price"), 10, 64)
+	if err != nil {
+		writeStatus(w, StatusMissing)
+		return
+	}
+	if md5Hex(r.PostForm.Get("price"), s.AppSecret) != r.PostForm.Get("sign") {
+		writeStatus(w, StatusSignError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[strings.TrimPrefix(r.URL.Path, "/api/refund/")]
+	switch {
+	case !ok:
+		writeStatus(w, xorpay.QueryStatusNotExist)
+	case order.PaidAt == nil:
+		writeStatus(w, StatusNotPaid)
+	case order.RefundedPrice+price > order.Price:
+		writeStatus(w, StatusOverPrice)
+	default:
+		order.RefundedPrice += price
+		writeStatus(w, "ok")
+	}
+}
+
+// Order returns a copy of the order created with the merchant order id orderId
+func (s *Server) Order(orderId string) (Order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, order := range s.orders {
+		if order.OrderID == orderId {
+			return *order, true
+		}
+	}
+	return Order{}, false
+}
+
+// Pay marks the order with the merchant order id orderId as paid and fires the notification to its notify url
+func (s *Server) Pay(orderId string) error {
+	s.mu.Lock()
+	var paying *Order
+	for _, order := range s.orders {
+		if order.OrderID == orderId {
+			paying = order
+		}
+	}
+	if paying == nil {
+		s.mu.Unlock()
+		return ErrOrderNotFound
+	}
+	if paying.PaidAt != nil {
+		s.mu.Unlock()
+		return ErrOrderPaid
+	}
+	if paying.Closed {
+		s.mu.Unlock()
+		return ErrOrderClosed
+	}
+	now := time.Now()
+	paying.PaidAt = &now
+	aoid := paying.PlatformOrderID
+	s.mu.Unlock()
+
+	return s.Notify(aoid)
+}
+
+// Notify fires a signed notification of the paid order identified by aoid to its notify url.
+// It could be called repeatedly to simulate the platform retrying a notification.
+func (s *Server) Notify(aoid string) error {
+	s.mu.Lock()
+	order, ok := s.orders[aoid]
+	if !ok {
+		s.mu.Unlock()
+		return ErrOrderNotFound
+	}
+	if order.PaidAt == nil {
+		s.mu.Unlock()
+		return ErrOrderNotPaid
+	}
+	order.Notifications++
+	payPrice := formatPrice(order.Price)
+	payTime := order.PaidAt.In(xorpay.Location).Format("2006-01-02 15:04:05")
+	detail, _ := json.Marshal(xorpay.PlatformNotifyResponseDetail{
+		TransactionID:    fmt.Sprintf("4200%028d", order.PaidAt.UnixNano()),
+		TransactionType:  "CFT",
+		TransactionBuyer: "xorpaytest",
+	})
+	v := url.Values{}
+	v.Set("aoid", order.PlatformOrderID)
+	v.Set("order_id", order.OrderID)
+	v.Set("pay_price", payPrice)
+	v.Set("pay_time", payTime)
+	v.Set("detail", string(detail))
+	v.Set("sign", md5Hex(order.PlatformOrderID, order.OrderID, payPrice, payTime, s.AppSecret))
+	notifyUrl := order.NotifyURL
+	s.mu.Unlock()
+
+	resp, err := s.NotifyClient.PostForm(notifyUrl, v)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("xorpaytest: notification rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}